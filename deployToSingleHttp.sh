@@ -24,13 +24,14 @@ while getopts "u:i:d:" opt; do
 done
 
 # CLEAN UP
-ssh $USER@$DOMAIN -i $IDENTITY -o StrictHostKeyChecking=no 'rm -rf gilpin-project5 && mkdir gilpin-project5' &&
+ssh $USER@$DOMAIN -i $IDENTITY -o StrictHostKeyChecking=no 'rm -rf gilpin-project5 && mkdir -p gilpin-project5/src/cdn' &&
 
 # scp source files
-  scp -i $IDENTITY src/cdn/httpserver/* popular_to_text.py Makefile-HTTP $USER@$DOMAIN:gilpin-project5 &&
+  scp -i $IDENTITY src/cdn/httpserver/* popular_to_text.py Makefile-HTTP cdn.secret $USER@$DOMAIN:gilpin-project5 &&
+  scp -r -i $IDENTITY src/cdn/protocol $USER@$DOMAIN:gilpin-project5/src/cdn &&
 
 # scp popular_raw.html into HTTP Server
   scp -3i $IDENTITY $USER@$CDN:/course/cs5700sp17/popular_raw.html $USER@$DOMAIN:gilpin-project5 &&
 
 # Make HTTP Server binary and clean up
-  ssh $USER@$DOMAIN -i $IDENTITY 'cd gilpin-project5 && mkdir .cache && mv Makefile-HTTP Makefile && python popular_to_text.py && rm *.html *.py && make && rm *.go Makefile'
+  ssh $USER@$DOMAIN -i $IDENTITY 'cd gilpin-project5 && mkdir .cache && mv Makefile-HTTP Makefile && python popular_to_text.py && rm *.html *.py && make && rm -r *.go Makefile src'
@@ -0,0 +1,16 @@
+# with a MaxMind license key fetch the GeoLite2 City database, the dns server is pointed at it with -mmdb
+# otherwise fall back to the legacy GeoLite csvs it loads into memory at startup, see -geo
+mkdir -p geo
+if [ -n "$MAXMIND_LICENSE_KEY" ]; then
+  wget -O GeoLite2-City.tar.gz "https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=$MAXMIND_LICENSE_KEY&suffix=tar.gz" 2> /dev/null &&
+    tar xzf GeoLite2-City.tar.gz &&
+    mv GeoLite2-City_*/GeoLite2-City.mmdb geo/GeoLite2-City.mmdb
+else
+  wget http://geolite.maxmind.com/download/geoip/database/GeoLiteCity_CSV/GeoLiteCity-latest.tar.xz 2> /dev/null &&
+    wget http://geolite.maxmind.com/download/geoip/database/GeoLiteCityv6-beta/GeoLiteCityv6.csv.gz 2> /dev/null &&
+    tar xf GeoLiteCity-latest.tar.xz &&
+    tail -n +3 < GeoLiteCity_*/GeoLiteCity-Blocks.csv > geo/blocks.csv &&
+    tail -n +3 < GeoLiteCity_*/GeoLiteCity-Location.csv > geo/locations.csv &&
+    gunzip -c GeoLiteCityv6.csv.gz > geo/blocks6.csv
+fi
+rm -r GeoLite*
@@ -0,0 +1,28 @@
+# converts the course's ec2-hosts.txt into a hosts.json for the dns server, see hosts.example.json
+# hosts are named like ec2-1-2-3-4.compute..., an extra column holding an ipv6 address is the
+# host's AAAA address and one holding a positive integer is its capacity
+import json
+import sys
+
+src = sys.argv[1] if len(sys.argv) > 1 else 'ec2-hosts.txt'
+dst = sys.argv[2] if len(sys.argv) > 2 else 'hosts.json'
+
+hosts = []
+with open(src, 'r') as fr:
+    for l in fr:
+        if 'Origin' in l or l.startswith('#') or not l.strip():
+            continue
+        fields = l.rstrip('\n').split('\t')
+        name = fields[0].strip()
+        host = {'id': name.split('.')[0], 'addresses': ['.'.join(name.split('.')[0].split('-')[1:5])]}
+        for field in fields[1:]:
+            field = field.strip()
+            if ':' in field and len(host['addresses']) == 1:
+                host['addresses'].append(field)
+            elif field.isdigit() and int(field) > 0:
+                host['capacity'] = int(field)
+        hosts.append(host)
+
+with open(dst, 'w') as fw:
+    json.dump({'hosts': hosts}, fw, indent=2)
+    fw.write('\n')
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"cdn/protocol"
+)
+
+// how many of the client's best ranked hosts, per replica of a name, are near enough to hash the name across
+const affinityNearbyFactor int = 2
+
+// sends a name to the few hosts it hashes to among the hosts near the client, so each host's cache
+// only needs to hold the content of the names it owns
+type affinity struct {
+	key      string // the name being answered
+	replicas int    // hosts each name is hashed to, 0 turns affinity off
+}
+
+// apply moves the hosts the name hashes to among the nearby ones to the front, keeping the ranked order
+// within the owners and within the rest, which stay behind them for failover
+func (a affinity) apply(ranked []string) []string {
+	if a.replicas < 1 || len(ranked) <= a.replicas {
+		return ranked
+	}
+	var nearby = ranked[:min(len(ranked), a.replicas*affinityNearbyFactor)]
+	var owners = protocol.RendezvousOwners(a.key, nearby, a.replicas)
+	return append(keep(ranked, owners), without(ranked, owners)...)
+}
+
+// keep returns the servers that are in include, in the order of servers
+func keep(servers, include []string) []string {
+	return without(servers, without(servers, include))
+}
+
+// ring returns the affinity ring for the given host, or nil if content isn't hashed across the hosts
+// clients are handed the hosts they rank best, which are the hosts near them, so a replica only hashes
+// paths across itself and the hosts nearest to it, as many as names are hashed across for a client
+// the ring lists the hosts by the address and port they serve http on, the caller must hold the hosts lock
+func (r *router) ring(self string) *protocol.AffinityRing {
+	if r.affinity < 1 {
+		return nil
+	}
+	var me = r.hosts[self]
+	var others = make([]string, 0, len(r.hosts))
+	for server := range r.hosts {
+		if server != self {
+			others = append(others, server)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		var di, dj = distance(me.loc, r.hosts[others[i]].loc), distance(me.loc, r.hosts[others[j]].loc)
+		return di < dj || di == dj && others[i] < others[j]
+	})
+	var nearby = append([]string{self}, others[:min(len(others), r.affinity*affinityNearbyFactor-1)]...)
+	var hosts = make([]string, 0, len(nearby))
+	for _, server := range nearby {
+		hosts = append(hosts, r.hosts[server].httpAddr(server))
+	}
+	return &protocol.AffinityRing{Hosts: hosts, Replicas: r.affinity, Self: me.httpAddr(self)}
+}
+
+// httpAddr returns the host's address and http port
+func (h *host) httpAddr(key string) string {
+	return net.JoinHostPort(key, strconv.Itoa(h.httpPort))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// limits on domain names from rfc 1035
+const (
+	maxLabelLength = 63
+	maxNameLength  = 255
+	// compression pointers only have 14 bits of offset
+	maxPointerOffset = 0x3FFF
+)
+
+// dnsReader reads fields out of a whole dns message so compressed names can be followed
+type dnsReader struct {
+	msg []byte
+	off int
+}
+
+// dnsWriter serializes a dns message, remembering where names were written so later names can point at them
+type dnsWriter struct {
+	buf   []byte
+	names map[string]int // lowercased name suffixes to their offset in buf
+}
+
+// readUint16 reads a big endian uint16 and advances the reader
+func (reader *dnsReader) readUint16() (uint16, error) {
+	if reader.off+2 > len(reader.msg) {
+		return 0, errors.New("Packet ended while reading 16 bit field")
+	}
+	var result = binary.BigEndian.Uint16(reader.msg[reader.off:])
+	reader.off += 2
+	return result, nil
+}
+
+// readUint32 reads a big endian uint32 and advances the reader
+func (reader *dnsReader) readUint32() (uint32, error) {
+	if reader.off+4 > len(reader.msg) {
+		return 0, errors.New("Packet ended while reading 32 bit field")
+	}
+	var result = binary.BigEndian.Uint32(reader.msg[reader.off:])
+	reader.off += 4
+	return result, nil
+}
+
+// readBytes reads the next n bytes and advances the reader
+func (reader *dnsReader) readBytes(n int) ([]byte, error) {
+	if reader.off+n > len(reader.msg) {
+		return nil, errors.New("Packet ended while reading " + intToString(n) + " bytes")
+	}
+	var result = reader.msg[reader.off : reader.off+n]
+	reader.off += n
+	return result, nil
+}
+
+// readName reads a possibly compressed domain name into its byte arrays format
+// pointers must point backwards in the message, which also rules out pointer loops
+func (reader *dnsReader) readName() ([][]byte, error) {
+	var name = make([][]byte, 0, 4)
+	var nameLength = 1
+	var off = reader.off
+	var jumped = false
+	for {
+		if off >= len(reader.msg) {
+			return nil, errors.New("Domain name runs past the end of the packet")
+		}
+		var length = int(reader.msg[off])
+		switch length & 0xC0 {
+		case 0x00:
+			if length == 0 {
+				if !jumped {
+					reader.off = off + 1
+				}
+				return name, nil
+			} else if off+1+length > len(reader.msg) {
+				return nil, errors.New("Domain name length is longer than entire packet")
+			}
+			nameLength += length + 1
+			if nameLength > maxNameLength {
+				return nil, errors.New("Domain name is longer than 255 bytes")
+			}
+			name = append(name, reader.msg[off+1:off+1+length])
+			off += length + 1
+		case 0xC0:
+			if off+2 > len(reader.msg) {
+				return nil, errors.New("Compression pointer runs past the end of the packet")
+			}
+			var target = int(binary.BigEndian.Uint16(reader.msg[off:]) & maxPointerOffset)
+			if target >= off {
+				return nil, errors.New("Compression pointer does not point backwards")
+			}
+			if !jumped {
+				reader.off = off + 2
+				jumped = true
+			}
+			off = target
+		default:
+			return nil, errors.New("Unsupported label type in domain name")
+		}
+	}
+}
+
+// newDNSWriter creates a writer for a message of up to capacity bytes
+func newDNSWriter(capacity int) *dnsWriter {
+	return &dnsWriter{make([]byte, 0, capacity), make(map[string]int)}
+}
+
+// writeUint16 appends a big endian uint16
+func (writer *dnsWriter) writeUint16(u16 uint16) {
+	writer.buf = binary.BigEndian.AppendUint16(writer.buf, u16)
+}
+
+// writeUint32 appends a big endian uint32
+func (writer *dnsWriter) writeUint32(u32 uint32) {
+	writer.buf = binary.BigEndian.AppendUint32(writer.buf, u32)
+}
+
+// writeBytes appends raw bytes
+func (writer *dnsWriter) writeBytes(bytes []byte) {
+	writer.buf = append(writer.buf, bytes...)
+}
+
+// writeName appends a domain name, replacing the longest suffix already in the message with a pointer
+func (writer *dnsWriter) writeName(name [][]byte) error {
+	var nameLength = 1
+	for i, label := range name {
+		if len(label) > maxLabelLength {
+			return errors.New("Domain label longer than 63 bytes")
+		}
+		nameLength += len(label) + 1
+		if nameLength > maxNameLength {
+			return errors.New("Domain name is longer than 255 bytes")
+		}
+		var suffix = strings.ToLower(byteArraysToDomain(name[i:]))
+		if off, seen := writer.names[suffix]; seen {
+			writer.writeUint16(0xC000 | uint16(off))
+			return nil
+		}
+		if len(writer.buf) <= maxPointerOffset {
+			writer.names[suffix] = len(writer.buf)
+		}
+		writer.buf = append(writer.buf, byte(len(label)))
+		writer.buf = append(writer.buf, label...)
+	}
+	writer.buf = append(writer.buf, 0)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// names written in order by one writer come back the same, and repeated suffixes are compressed
+func TestNameRoundTrip(t *testing.T) {
+	var tests = []struct {
+		names []string
+		size  int // expected message size, showing which suffixes were replaced by pointers
+	}{
+		{[]string{""}, 1},
+		{[]string{"com"}, 5},
+		{[]string{"cdn.example.com", "cdn.example.com"}, 17 + 2},
+		{[]string{"cdn.example.com", "www.example.com"}, 17 + 4 + 2},
+		{[]string{"cdn.example.com", "CDN.Example.COM"}, 17 + 2},
+		{[]string{"a.b.c", "x.b.c", "y.x.b.c", "c"}, 7 + 4 + 4 + 2},
+		{[]string{"example.com", "example.org"}, 13 + 13},
+		{[]string{strings.Repeat("a", 63) + ".com", strings.Repeat("a", 63) + ".com"}, 69 + 2},
+	}
+	for _, test := range tests {
+		var writer = newDNSWriter(512)
+		for _, name := range test.names {
+			if err := writer.writeName(domainToByteArrays(name)); err != nil {
+				t.Fatalf("%v: writing %q: %v", test.names, name, err)
+			}
+		}
+		if len(writer.buf) != test.size {
+			t.Errorf("%v: wrote %d bytes, want %d", test.names, len(writer.buf), test.size)
+		}
+		var reader = &dnsReader{msg: writer.buf}
+		for _, name := range test.names {
+			read, err := reader.readName()
+			if err != nil {
+				t.Fatalf("%v: reading %q: %v", test.names, name, err)
+			}
+			// suffixes match case insensitively, so a compressed name takes on the case of the earlier one
+			if !strings.EqualFold(byteArraysToDomain(read), name) {
+				t.Errorf("%v: read %q, want %q", test.names, byteArraysToDomain(read), name)
+			}
+		}
+		if reader.off != len(writer.buf) {
+			t.Errorf("%v: reader stopped at %d of %d bytes", test.names, reader.off, len(writer.buf))
+		}
+	}
+}
+
+// the reader continues right after a pointer, not where the pointer led
+func TestReadNameAfterPointer(t *testing.T) {
+	var msg = []byte{3, 'c', 'o', 'm', 0, 1, 'a', 0xC0, 0, 0xAB, 0xCD}
+	var reader = &dnsReader{msg: msg, off: 5}
+	name, err := reader.readName()
+	if err != nil || byteArraysToDomain(name) != "a.com" {
+		t.Fatalf("read %q, %v", byteArraysToDomain(name), err)
+	}
+	if next, err := reader.readUint16(); err != nil || next != 0xABCD {
+		t.Errorf("read %x after the name, %v", next, err)
+	}
+}
+
+// malformed names are rejected rather than read past the message or followed forever
+func TestReadNameRejects(t *testing.T) {
+	var long = make([]byte, 0, 300)
+	for i := 0; i < 5; i++ {
+		long = append(long, 63)
+		long = append(long, bytes.Repeat([]byte{'a'}, 63)...)
+	}
+	long = append(long, 0)
+
+	var tests = []struct {
+		name string
+		msg  []byte
+		off  int
+	}{
+		{"empty message", []byte{}, 0},
+		{"missing terminator", []byte{3, 'c', 'o', 'm'}, 0},
+		{"truncated label", []byte{5, 'c', 'o', 'm'}, 0},
+		{"label past the end", []byte{3, 'c', 'o', 'm', 0x3F}, 0},
+		{"truncated pointer", []byte{3, 'c', 'o', 'm', 0xC0}, 0},
+		{"pointer to itself", []byte{0xC0, 0}, 0},
+		{"forward pointer", []byte{0xC0, 2, 3, 'c', 'o', 'm', 0}, 0},
+		{"pointer past the end", []byte{0xC0, 0xFF}, 0},
+		{"pointer loop", []byte{1, 'a', 0xC0, 4, 1, 'b', 0xC0, 0}, 4},
+		{"pointer into a loop", []byte{0xC0, 2, 0xC0, 0}, 2},
+		{"extended label type", []byte{0x40, 0}, 0},
+		{"reserved label type", []byte{0x80, 0}, 0},
+		{"name longer than 255 bytes", long, 0},
+	}
+	for _, test := range tests {
+		var reader = &dnsReader{msg: test.msg, off: test.off}
+		if name, err := reader.readName(); err == nil {
+			t.Errorf("%s: read %q, want an error", test.name, byteArraysToDomain(name))
+		}
+	}
+}
+
+// names that can't be represented aren't written
+func TestWriteNameRejects(t *testing.T) {
+	var tests = []struct {
+		name   string
+		domain [][]byte
+	}{
+		{"label longer than 63 bytes", [][]byte{bytes.Repeat([]byte{'a'}, 64), []byte("com")}},
+		{"name longer than 255 bytes", [][]byte{
+			bytes.Repeat([]byte{'a'}, 63), bytes.Repeat([]byte{'b'}, 63),
+			bytes.Repeat([]byte{'c'}, 63), bytes.Repeat([]byte{'d'}, 63)}},
+	}
+	for _, test := range tests {
+		if err := newDNSWriter(512).writeName(test.domain); err == nil {
+			t.Errorf("%s: written, want an error", test.name)
+		}
+	}
+}
+
+// fixed size fields are rejected once the message runs out
+func TestReadFieldsTruncated(t *testing.T) {
+	var reader = &dnsReader{msg: []byte{1, 2, 3}}
+	if _, err := reader.readUint32(); err == nil {
+		t.Error("read a 32 bit field from 3 bytes")
+	}
+	if value, err := reader.readUint16(); err != nil || value != 0x0102 {
+		t.Errorf("read %x, %v", value, err)
+	}
+	if _, err := reader.readUint16(); err == nil {
+		t.Error("read a 16 bit field from 1 byte")
+	}
+	if _, err := reader.readBytes(2); err == nil {
+		t.Error("read 2 bytes from 1")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"cdn/protocol"
+)
+
+// how long a write to a replica may block before the connection is given up on
+const controlWriteTimeout = 2 * time.Second
+
+// most ping requests allowed to wait on a replica's results before they are all forgotten
+const maxPendingPings int = 4096
+
+// returned when sending to a replica that isn't connected right now
+var errNotConnected = errors.New("Control channel is not connected")
+
+// the control channel to a replica's http server, kept up by a supervising thread
+type controlConn struct {
+	addr    *net.TCPAddr
+	secret  []byte
+	conn    *protocol.Conn         // nil while disconnected
+	nextID  uint64                 // id of the next ping request
+	pending map[uint64]string      // ids of ping requests still waiting on a result to their clients
+	ring    *protocol.AffinityRing // sent to the replica on every connect, nil when affinity is off
+	newRing chan bool              // wakes the ring sender when the ring changes
+	closed  chan bool              // closed once the host is removed, stopping the supervisor
+	mutex   sync.Mutex             // lock for conn, nextID, pending and ring
+}
+
+// newControlConn creates the control channel to addr authenticated with secret, call supervise to connect it
+func newControlConn(addr *net.TCPAddr, secret []byte) *controlConn {
+	return &controlConn{addr: addr, secret: secret, pending: make(map[uint64]string),
+		newRing: make(chan bool, 1), closed: make(chan bool)}
+}
+
+// what a control channel does with each kind of message its replica sends
+type controlHandlers struct {
+	ping    func(result protocol.PingResult)    // results of ping requests sent over the channel
+	passive func(report protocol.PassiveReport) // rtts seen on live connections
+	load    func(report protocol.LoadReport)    // how busy the replica is
+}
+
+// supervise connects to the replica and hands every message it sends to handlers until the channel is closed
+// whenever the connection can't be made or drops it is retried with exponential backoff,
+// so replicas that are down at startup or restart later are picked up once they come back
+func (control *controlConn) supervise(handlers controlHandlers) {
+	go control.sendRings()
+	var backoff protocol.Backoff
+	for !control.isClosed() {
+		conn, err := control.connect()
+		if err != nil {
+			errorCheck(err)
+			backoff.Wait(control.closed)
+			continue
+		}
+		fmt.Println("Connected to control channel", control.addr)
+		backoff.Reset()
+		control.mutex.Lock()
+		if control.isClosed() {
+			// closed while connecting, close found no connection to drop
+			control.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		control.conn = conn
+		control.mutex.Unlock()
+
+		for {
+			typ, payload, err := conn.ReadFrame()
+			if err != nil {
+				fmt.Println("Lost control channel", control.addr, err)
+				break
+			}
+			if typ == protocol.MsgPassiveRTT {
+				var report protocol.PassiveReport
+				if !errorCheck(json.Unmarshal(payload, &report)) {
+					handlers.passive(report)
+				}
+				continue
+			} else if typ == protocol.MsgLoadReport {
+				var report protocol.LoadReport
+				if !errorCheck(json.Unmarshal(payload, &report)) {
+					handlers.load(report)
+				}
+				continue
+			}
+			var result protocol.PingResult
+			if typ != protocol.MsgPingResult || errorCheck(json.Unmarshal(payload, &result)) {
+				// message types added by newer replicas are skipped
+				continue
+			}
+			// results for requests we never sent, or already got, are dropped
+			control.mutex.Lock()
+			var client, requested = control.pending[result.ID]
+			requested = requested && client == result.Client
+			if requested {
+				delete(control.pending, result.ID)
+			}
+			control.mutex.Unlock()
+			if requested {
+				handlers.ping(result)
+			}
+		}
+
+		control.mutex.Lock()
+		control.conn = nil
+		control.pending = make(map[uint64]string)
+		control.mutex.Unlock()
+		conn.Close()
+	}
+}
+
+// connect dials the replica, runs the handshake and tells the replica its affinity ring
+func (control *controlConn) connect() (*protocol.Conn, error) {
+	conn, err := net.DialTCP("tcp", nil, control.addr)
+	if err != nil {
+		return nil, err
+	}
+	var pc = protocol.NewConn(conn, nil)
+	if err = pc.ControllerHandshake(control.secret); err != nil {
+		conn.Close()
+		return nil, errors.New("Handshake with " + control.addr.String() + " failed: " + err.Error())
+	}
+	control.mutex.Lock()
+	var ring = control.ring
+	control.mutex.Unlock()
+	if ring != nil {
+		if err = pc.WriteMessage(protocol.MsgAffinity, ring); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+// setRing replaces the replica's affinity ring without blocking, the ring sender sends it right away
+// if the replica is connected and connect sends it otherwise, a nil ring means affinity is off and is never sent
+func (control *controlConn) setRing(ring *protocol.AffinityRing) {
+	control.mutex.Lock()
+	control.ring = ring
+	control.mutex.Unlock()
+	select {
+	case control.newRing <- true:
+	default:
+		// the sender hasn't picked up the last change yet, it will send this ring instead
+	}
+}
+
+// sendRings sends the replica its ring whenever it changes, until the channel is closed
+// a replica slow to read only holds up its own ring, never the router
+func (control *controlConn) sendRings() {
+	for {
+		select {
+		case <-control.closed:
+			return
+		case <-control.newRing:
+		}
+		control.mutex.Lock()
+		var conn, ring = control.conn, control.ring
+		control.mutex.Unlock()
+		if conn == nil || ring == nil {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+		if err := conn.WriteMessage(protocol.MsgAffinity, ring); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// close stops the supervisor and drops the connection, the host has been removed
+func (control *controlConn) close() {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if control.isClosed() {
+		return
+	}
+	close(control.closed)
+	if control.conn != nil {
+		control.conn.Close()
+	}
+}
+
+// isClosed returns whether close has been called
+func (control *controlConn) isClosed() bool {
+	select {
+	case <-control.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestPing asks the replica to measure its rtt to client, failing fast with errNotConnected while it is down
+// a failed write closes the connection so the supervisor reconnects
+func (control *controlConn) requestPing(client string) error {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if control.conn == nil {
+		return errNotConnected
+	}
+	if len(control.pending) >= maxPendingPings {
+		// the replica is not keeping up, forget what it owes us rather than growing forever
+		control.pending = make(map[uint64]string)
+	}
+	control.nextID++
+	control.pending[control.nextID] = client
+	control.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	var err = control.conn.WriteMessage(protocol.MsgPingRequest, protocol.PingRequest{ID: control.nextID, Client: client})
+	if err != nil {
+		control.conn.Close()
+	}
+	return err
+}
@@ -8,28 +8,36 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"syscall"
+
+	"cdn/protocol"
 )
 
 type udpPacket struct {
-	body []byte
-	addr net.UDPAddr
+	body       []byte
+	addr       net.UDPAddr
+	connection *net.UDPConn // socket the packet came in on, and the response goes out on
 }
 
+// number of queued packets waiting for a free handler before readers stop reading
+const packetQueueSize = 1024
+
 /* outgoing answers:
 qr = 1
 aa = 1
 qdcount = 1
-ancount = 1
-nscount = 0
-arcount = 0
+ancount = number of answer records, up to the zone's answer count of ranked servers for A and AAAA
+nscount = number of authority records, the zone's SOA for NXDOMAIN and NODATA responses
+arcount = number of additional records, glue for in zone name servers
 copy question from incoming answer
 name = domain name
-type = A
+type = A, AAAA, CNAME, NS or SOA
 class = IN
-ttl = 0
+ttl = between the zone's min and max ttl for A and AAAA, depending on routing confidence
 rdlength = length of data
-rdata = ip address
+rdata = ipv4 or ipv6 address, alias target, name server name, or start of authority
 
 incoming answers:
 qr = 1
@@ -39,7 +47,7 @@ ancount = 0
 nscount = 0
 arcount = 0
 name = domain name
-type = A
+type = A or AAAA
 
 opcode = 0
 tc = 0
@@ -50,6 +58,38 @@ rcode = 0
 
 */
 
+// record types served by this dns server
+const (
+	typeA     uint16 = 1
+	typeNS    uint16 = 2
+	typeCNAME uint16 = 5
+	typeSOA   uint16 = 6
+	typeTXT   uint16 = 16 // only answered for _explain queries
+	typeAAAA  uint16 = 28
+)
+
+// record classes, only IN is served
+const (
+	classIN  uint16 = 1
+	classANY uint16 = 255
+)
+
+// response codes
+const (
+	rcodeNoError  uint8 = 0
+	rcodeFormErr  uint8 = 1
+	rcodeServFail uint8 = 2
+	rcodeNXDomain uint8 = 3
+	rcodeNotImp   uint8 = 4
+	rcodeRefused  uint8 = 5
+)
+
+// errNoData means the name exists but has nothing of the requested type, which is answered with NODATA
+var errNoData = errors.New("No records of the requested type")
+
+// errNXDomain means the name does not exist in the zone
+var errNXDomain = errors.New("No such name in zone")
+
 type dnsPacket struct {
 	id     uint16
 	qr     bool
@@ -59,11 +99,13 @@ type dnsPacket struct {
 	rd     bool
 	ra     bool
 	// 3 empty bits for z
-	rcode    uint8 // truncate to 4 bits
-	qdcount  uint16
-	ancount  uint16
-	question *dnsQuestion
-	answer   *dnsAnswer
+	rcode      uint8 // lower 4 bits go in the header, the rest in the OPT record
+	qdcount    uint16
+	question   *dnsQuestion
+	answers    []*dnsRecord
+	authority  []*dnsRecord
+	additional []*dnsRecord // without the OPT record, which is kept in edns
+	edns       *ednsOpt     // nil if the query did not use EDNS0
 }
 
 type dnsQuestion struct {
@@ -72,13 +114,38 @@ type dnsQuestion struct {
 	qclass uint16
 }
 
-type dnsAnswer struct {
-	aname    [][]byte
-	atype    uint16
-	aclass   uint16
-	ttl      uint32
-	rdlength uint16
-	rdata    []byte
+// a resource record, used for the answer, authority and additional sections
+type dnsRecord struct {
+	name  [][]byte
+	rtype uint16
+	class uint16
+	ttl   uint32
+	rdata rdata
+}
+
+// rdata is the type specific part of a record, it serializes itself so names inside it can be compressed
+type rdata interface {
+	writeTo(writer *dnsWriter) error
+}
+
+// rdata without names in it, such as addresses, or parsed records of types we don't interpret
+type rawRdata []byte
+
+// rdata holding a single domain name, such as NS records
+type nameRdata [][]byte
+
+// rdata for TXT records, each string at most 255 bytes
+type txtRdata []string
+
+// rdata for SOA records
+type soaRdata struct {
+	mname   [][]byte
+	rname   [][]byte
+	serial  uint32
+	refresh uint32
+	retry   uint32
+	expire  uint32
+	minimum uint32
 }
 
 // errorCheck is a convenience function that will print errors to std error if there is one
@@ -116,28 +183,119 @@ func byteArraysToDomain(b [][]byte) string {
 	return result
 }
 
-// queryDNSToAnswer initialize a default dns packet that points to california
-func (packet *dnsPacket) queryDNSToAnswer(ip net.IP, r router) error {
-	var returnIP = net.ParseIP(r.getServer(ip.String())).To4()
-	if returnIP == nil {
-		return errors.New("Bad IP to return")
+// domainToByteArrays converts the string format of a domain to its byte arrays format
+func domainToByteArrays(domain string) [][]byte {
+	result := make([][]byte, 0, 4)
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if label != "" {
+			result = append(result, []byte(label))
+		}
+	}
+	return result
+}
+
+// queryDNSToRcode turns the query into an empty response with the given rcode
+// authoritative negative answers (NXDOMAIN and NODATA) carry the zone's SOA in the authority section
+// z is nil when the query could not be matched to one of our zones
+func (packet *dnsPacket) queryDNSToRcode(rcode uint8, z *zone) {
+	packet.qr = true
+	packet.aa = z != nil && (rcode == rcodeNoError || rcode == rcodeNXDomain)
+	packet.tc = false
+	packet.ra = false
+	packet.rcode = rcode
+	packet.answers = nil
+	packet.authority = nil
+	packet.additional = nil
+	if packet.aa {
+		packet.authority = []*dnsRecord{z.soa()}
+	}
+}
+
+// queryDNSToAnswer turns the query for domain in zone z from client ip into an answer
+// the apex answers SOA and NS queries with the zone's authority data, in zone name servers answer
+// with their glue addresses, and routed names answer with the best servers in their pool for the client
+// aliases answer with a CNAME, followed by the target's addresses when it is a routed name we serve
+func (packet *dnsPacket) queryDNSToAnswer(domain string, ip net.IP, z *zone, zones *zoneTable, r *router) error {
+	var qtype = packet.question.qtype
+	var answers, authority, additional []*dnsRecord
+	var record = z.lookup(domain)
+	var err error
+	var _, _, explain = explainedDomain(domain)
+	switch {
+	case explain && r.explainTXT && qtype == typeTXT:
+		answers, err = packet.explainRecords(domain, ip, zones, r)
+	case domain == z.name && qtype == typeSOA:
+		answers = []*dnsRecord{z.soa()}
+		authority = z.nsRecords()
+		additional = z.glue()
+	case domain == z.name && qtype == typeNS:
+		answers = z.nsRecords()
+		additional = z.glue()
+	case z.getNameserver(domain) != nil:
+		answers = z.getNameserver(domain).addressRecords(qtype)
+	case record == nil && domain != z.name && !z.hasDescendant(domain):
+		return errNXDomain
+	case record == nil:
+		// the name exists but only has records below it
+	case record.cname != "":
+		var target = domainToByteArrays(record.cname)
+		answers = []*dnsRecord{{packet.question.qname, typeCNAME, classIN, z.maxTTL, nameRdata(target)}}
+		// save the resolver a round trip when the alias points at one of our own routed names
+		var targetZone = zones.find(record.cname)
+		if targetZone != nil && qtype != typeCNAME {
+			if targetRecord := targetZone.lookup(record.cname); targetRecord != nil && targetRecord.cname == "" {
+				var targetAnswers []*dnsRecord
+				targetAnswers, err = packet.routedRecords(target, targetRecord, targetZone, ip, r)
+				answers = append(answers, targetAnswers...)
+			}
+		}
+	case qtype == typeA || qtype == typeAAAA:
+		answers, err = packet.routedRecords(packet.question.qname, record, z, ip, r)
+	}
+	if err != nil {
+		return err
+	} else if len(answers) == 0 {
+		return errNoData
 	}
 	packet.qr = true
 	packet.aa = true
-	packet.ancount = 1
-	packet.answer = &dnsAnswer{
-		packet.question.qname,
-		1,        // A
-		1,        // IN
-		0,        // no caching yet
-		4,        // one ip address
-		returnIP} // california
+	packet.tc = false
+	packet.ra = false
+	packet.rcode = rcodeNoError
+	packet.answers = answers
+	packet.authority = authority
+	packet.additional = additional
 	return nil
 }
 
+// routedRecords builds the A or AAAA records named owner for the best servers in the record's pool
+// one record per ranked server, clients fail over down the list if the first is unreachable
+func (packet *dnsPacket) routedRecords(owner [][]byte, record *zoneRecord, z *zone, ip net.IP, r *router) ([]*dnsRecord, error) {
+	var qtype = packet.question.qtype
+	if qtype != typeA && qtype != typeAAAA {
+		return nil, nil
+	}
+	var servers = r.getServers(ip.String(), qtype == typeAAAA, z.answers, record.hosts,
+		affinity{strings.ToLower(byteArraysToDomain(owner)), z.affinity})
+	var ttl = z.answerTTL(r.confidence(ip.String(), qtype == typeAAAA, record.hosts))
+	var result = make([]*dnsRecord, 0, len(servers))
+	for _, server := range servers {
+		var returnIP, exists = r.address(server, qtype == typeAAAA)
+		if !exists {
+			// removed by a reload since it was chosen
+			continue
+		} else if returnIP == nil {
+			return nil, errors.New("Bad IP to return")
+		}
+		result = append(result, &dnsRecord{owner, qtype, classIN, ttl, rawRdata(returnIP)})
+	}
+	// the servers were chosen for the client's subnet, resolvers may reuse them for all of it
+	packet.edns.scopeToSource()
+	return result, nil
+}
+
 // parseDNS parses a DNS packet from an array of bytes
 func (packet *dnsPacket) parseDNS(bytes []byte) error {
-	fmt.Println("BYTES: ", bytes)
 	if len(bytes) < 12 {
 		return errors.New("DNS packet must be at least 12 bytes.")
 	} else if bytes[3]&112 != 0 {
@@ -155,218 +313,384 @@ func (packet *dnsPacket) parseDNS(bytes []byte) error {
 	packet.ra = bytes[3]&128 != 0
 	packet.rcode = bytes[3] & 15
 	packet.qdcount = binary.BigEndian.Uint16(bytes[4:6])
+	var ancount = binary.BigEndian.Uint16(bytes[6:8])
+	var nscount = binary.BigEndian.Uint16(bytes[8:10])
+	var arcount = binary.BigEndian.Uint16(bytes[10:12])
 
 	// parsing question
-	if packet.qdcount >= 1 {
-		packet.question = &dnsQuestion{}
-		leftover, err := packet.question.parseDNSQuestion(bytes[12:])
-		if err != nil {
+	var reader = &dnsReader{bytes, 12}
+	if packet.qdcount > 1 {
+		return errors.New("Only one question per packet is supported")
+	} else if packet.qdcount == 1 {
+		var question = &dnsQuestion{}
+		if err := question.parseDNSQuestion(reader); err != nil {
 			return err
 		}
-		leftoverLen := len(leftover)
-		if leftoverLen > 0 {
-			fmt.Fprintln(os.Stderr, "Warning, more than one question in dns response, leftover bytes: ", leftoverLen)
-		}
+		packet.question = question
+	}
+
+	// parsing records
+	var err error
+	if packet.answers, err = parseDNSRecords(reader, ancount); err != nil {
+		return err
+	}
+	if packet.authority, err = parseDNSRecords(reader, nscount); err != nil {
+		return err
+	}
+	if packet.additional, err = parseDNSRecords(reader, arcount); err != nil {
+		return err
+	}
+	if err = packet.extractEDNS(); err != nil {
+		return err
+	}
+	if leftoverLen := len(bytes) - reader.off; leftoverLen > 0 {
+		fmt.Fprintln(os.Stderr, "Warning, leftover bytes after the last dns record: ", leftoverLen)
 	}
 
 	return nil
 }
 
-// Initializes the dnsQuestion, and returns the leftover bytes to read
-func (question *dnsQuestion) parseDNSQuestion(bytes []byte) ([]byte, error) {
-	bLen := len(bytes)
-	currentByte := 0
-	question.qname = make([][]byte, 0, 2)
-	for currentByte < bLen {
-		lengthOfDomain := int(bytes[currentByte])
-		if lengthOfDomain == 0 {
-			currentByte += 1
-			break
-		} else if lengthOfDomain+currentByte+1 >= bLen {
-			return nil, errors.New("Domain name length is longer than entire packet")
-		} else {
-			question.qname = append(question.qname, bytes[currentByte+1:currentByte+1+lengthOfDomain])
-			currentByte += lengthOfDomain + 1
-		}
+// Initializes the dnsQuestion from the reader's current position
+func (question *dnsQuestion) parseDNSQuestion(reader *dnsReader) error {
+	var err error
+	if question.qname, err = reader.readName(); err != nil {
+		return err
+	}
+	if question.qtype, err = reader.readUint16(); err != nil {
+		return errors.New("No data for QType and QClass")
 	}
-	if bLen < currentByte+4 {
-		return nil, errors.New("No data for QType and QClass")
+	if question.qclass, err = reader.readUint16(); err != nil {
+		return errors.New("No data for QType and QClass")
 	}
-	question.qtype = binary.BigEndian.Uint16(bytes[currentByte : currentByte+2])
-	question.qclass = binary.BigEndian.Uint16(bytes[currentByte+2 : currentByte+4])
-	return bytes[currentByte+4:], nil
+	return nil
 }
 
-// dnsToBytes serializes the dns packet into a byte array
-func (dns *dnsPacket) dnsToBytes() ([]byte, error) {
-	result := make([]byte, 12, 512)
-	binary.BigEndian.PutUint16(result, dns.id)
-	result[2] = (boolToByte(dns.qr) << 7) + (dns.opcode & 15 << 3)
-	result[2] += (boolToByte(dns.aa) << 2) + (boolToByte(dns.tc) << 1) + boolToByte(dns.rd)
-	result[3] = (boolToByte(dns.ra) << 7) + (dns.rcode & 15)
-	binary.BigEndian.PutUint16(result[4:], dns.qdcount)
-	binary.BigEndian.PutUint16(result[6:], dns.ancount)
-	qbytes, err := dns.question.writeToBytes()
-	if errorCheck(err) {
-		return nil, err
+// parseDNSRecords reads count records from the reader's current position
+func parseDNSRecords(reader *dnsReader, count uint16) ([]*dnsRecord, error) {
+	var result = make([]*dnsRecord, 0, count)
+	for i := uint16(0); i < count; i++ {
+		var record = &dnsRecord{}
+		var err error
+		if record.name, err = reader.readName(); err != nil {
+			return nil, err
+		}
+		if record.rtype, err = reader.readUint16(); err != nil {
+			return nil, err
+		}
+		if record.class, err = reader.readUint16(); err != nil {
+			return nil, err
+		}
+		if record.ttl, err = reader.readUint32(); err != nil {
+			return nil, err
+		}
+		rdlength, err := reader.readUint16()
+		if err != nil {
+			return nil, err
+		}
+		rbytes, err := reader.readBytes(int(rdlength))
+		if err != nil {
+			return nil, err
+		}
+		record.rdata = rawRdata(rbytes)
+		result = append(result, record)
 	}
-	abytes, err := dns.answer.writeToBytes()
-	if errorCheck(err) {
-		return nil, err
+	return result, nil
+}
+
+// dnsToBytes serializes the dns packet into a byte array of at most limit bytes
+// if the records don't fit they are all dropped and the tc bit is set so the client retries over tcp
+func (dns *dnsPacket) dnsToBytes(limit int) ([]byte, error) {
+	result, err := dns.writeToBytes()
+	if err != nil || len(result) <= limit {
+		return result, err
 	}
-	result = append(result, qbytes...)
-	result = append(result, abytes...)
-	if len(result) > 512 {
+	var truncated = *dns
+	truncated.tc = true
+	truncated.answers = nil
+	truncated.authority = nil
+	truncated.additional = nil
+	result, err = truncated.writeToBytes()
+	if err != nil {
+		return nil, err
+	} else if len(result) > limit {
 		return nil, errors.New("Too much data for dns packet")
-	} else {
-		return result, nil
 	}
+	return result, nil
 }
 
-// nameToBytes turns a byte arrays representation back into its bytes representation
-func nameToBytes(name [][]byte) ([]byte, error) {
-	result := make([]byte, 0, 512)
-	for _, bytes := range name {
-		bLen := len(bytes)
-		if bLen >= 256 {
-			return nil, errors.New("Domain too long to be represented by a single byte")
+// writeToBytes serializes the dns packet into a byte array, compressing repeated names
+func (dns *dnsPacket) writeToBytes() ([]byte, error) {
+	writer := newDNSWriter(int(maxUDPPayload))
+	writer.writeUint16(dns.id)
+	var flags = uint16((boolToByte(dns.qr) << 7) + (dns.opcode & 15 << 3))
+	flags += uint16((boolToByte(dns.aa) << 2) + (boolToByte(dns.tc) << 1) + boolToByte(dns.rd))
+	flags = flags<<8 + uint16((boolToByte(dns.ra)<<7)+(dns.rcode&15))
+	writer.writeUint16(flags)
+	if dns.question != nil {
+		writer.writeUint16(1)
+	} else {
+		writer.writeUint16(0)
+	}
+	writer.writeUint16(uint16(len(dns.answers)))
+	writer.writeUint16(uint16(len(dns.authority)))
+	var additional = dns.additional
+	if dns.edns != nil {
+		additional = append(additional[:len(additional):len(additional)], dns.edns.response(dns.rcode))
+	}
+	writer.writeUint16(uint16(len(additional)))
+	if err := dns.question.writeTo(writer); errorCheck(err) {
+		return nil, err
+	}
+	for _, section := range [][]*dnsRecord{dns.answers, dns.authority, additional} {
+		for _, record := range section {
+			if err := record.writeTo(writer); errorCheck(err) {
+				return nil, err
+			}
 		}
-		result = append(result, byte(bLen))
-		result = append(result, bytes...)
 	}
-	result = append(result, 0)
-	return result, nil
+	return writer.buf, nil
 }
 
-// bigEndianBytes is a convenience method that returns a uint16 as an array of Big Endian bytes
-func bigEndianBytes(u16 uint16) []byte {
-	result := make([]byte, 2)
-	binary.BigEndian.PutUint16(result, u16)
-	return result
+// writeTo serializes a dnsQuestion, a nil question is empty
+func (question *dnsQuestion) writeTo(writer *dnsWriter) error {
+	if question == nil {
+		return nil
+	}
+	if err := writer.writeName(question.qname); err != nil {
+		return err
+	}
+	writer.writeUint16(question.qtype)
+	writer.writeUint16(question.qclass)
+	return nil
 }
 
-// writeToBytes serializes a dnsQuestion into byte format
-func (question *dnsQuestion) writeToBytes() ([]byte, error) {
-	result, err := nameToBytes(question.qname)
-	if err != nil {
-		return nil, err
+// writeTo serializes a dnsRecord, filling in rdlength once the rdata is written
+func (record *dnsRecord) writeTo(writer *dnsWriter) error {
+	if err := writer.writeName(record.name); err != nil {
+		return err
 	}
-	result = append(result, bigEndianBytes(question.qtype)...)
-	result = append(result, bigEndianBytes(question.qclass)...)
-	return result, nil
+	writer.writeUint16(record.rtype)
+	writer.writeUint16(record.class)
+	writer.writeUint32(record.ttl)
+	var lengthOffset = len(writer.buf)
+	writer.writeUint16(0)
+	if err := record.rdata.writeTo(writer); err != nil {
+		return err
+	}
+	var rdlength = len(writer.buf) - lengthOffset - 2
+	if rdlength > 0xFFFF {
+		return errors.New("Record data too long")
+	}
+	binary.BigEndian.PutUint16(writer.buf[lengthOffset:], uint16(rdlength))
+	return nil
 }
 
-// writeToBytes serializes a dnsAnswer into byte format
-func (answer *dnsAnswer) writeToBytes() ([]byte, error) {
-	result, err := nameToBytes(answer.aname)
-	if err != nil {
-		return nil, err
+func (raw rawRdata) writeTo(writer *dnsWriter) error {
+	writer.writeBytes(raw)
+	return nil
+}
+
+func (name nameRdata) writeTo(writer *dnsWriter) error {
+	return writer.writeName(name)
+}
+
+func (txt txtRdata) writeTo(writer *dnsWriter) error {
+	for _, text := range txt {
+		writer.writeBytes([]byte{byte(len(text))})
+		writer.writeBytes([]byte(text))
 	}
-	result = append(result, bigEndianBytes(answer.atype)...)
-	result = append(result, bigEndianBytes(answer.aclass)...)
-	bttl := make([]byte, 4)
-	binary.BigEndian.PutUint32(bttl, answer.ttl)
-	result = append(result, bttl...)
-	result = append(result, bigEndianBytes(answer.rdlength)...)
-	result = append(result, answer.rdata...)
-	return result, nil
+	return nil
+}
+
+func (soa *soaRdata) writeTo(writer *dnsWriter) error {
+	if err := writer.writeName(soa.mname); err != nil {
+		return err
+	}
+	if err := writer.writeName(soa.rname); err != nil {
+		return err
+	}
+	for _, field := range []uint32{soa.serial, soa.refresh, soa.retry, soa.expire, soa.minimum} {
+		writer.writeUint32(field)
+	}
+	return nil
 }
 
 // handleRequest responds to the incoming udpPacket and returns the proper dns response
-func handleRequest(packet *udpPacket, name string, r router) *udpPacket {
+func handleRequest(packet *udpPacket, zones *zoneTable, r *router) *udpPacket {
 	// fmt.Println(packet)
-	var dns = &dnsPacket{}
-	var err = dns.parseDNS(packet.body)
-	fmt.Println("DNS Header: ", *dns)
-	fmt.Println("DNS Question: ", dns.question)
-	if errorCheck(err) || byteArraysToDomain(dns.question.qname) != name {
+	var response = handleQuery(packet.body, packet.addr.IP, false, zones, r)
+	if response == nil {
 		return nil
 	}
-	fmt.Println("DNS Domain: ", byteArraysToDomain(dns.question.qname))
-	err = dns.queryDNSToAnswer(packet.addr.IP, r)
-	if errorCheck(err) {
+	packet.body = response
+	return packet
+}
+
+// handleQuery responds to a dns message from the client and returns the serialized response
+// udp responses must fit the client's payload size, tcp responses only the 16 bit length prefix
+// messages too short to hold a header and messages that are themselves responses are dropped
+func handleQuery(body []byte, client net.IP, tcp bool, zones *zoneTable, r *router) []byte {
+	var dns = &dnsPacket{}
+	var err = dns.parseDNS(body)
+	if len(body) < 12 || dns.qr {
+		errorCheck(err)
 		return nil
 	}
-	packet.body, err = dns.dnsToBytes()
+	var rcode = rcodeNoError
+	var z *zone
+	switch {
+	case errorCheck(err) || dns.question == nil:
+		rcode = rcodeFormErr
+	case dns.edns != nil && dns.edns.version > 0:
+		rcode = rcodeBadVers
+	case dns.opcode != 0:
+		rcode = rcodeNotImp
+	case dns.question.qclass != classIN && dns.question.qclass != classANY:
+		rcode = rcodeRefused
+	default:
+		var domain = strings.ToLower(byteArraysToDomain(dns.question.qname))
+		if z = zones.find(domain); z == nil {
+			rcode = rcodeRefused
+		} else if err = dns.queryDNSToAnswer(domain, dns.edns.clientIP(client), z, zones, r); err == errNXDomain {
+			rcode = rcodeNXDomain
+		} else if err == errNoData {
+			// the name exists, there is just nothing of this type to hand out
+			dns.queryDNSToRcode(rcodeNoError, z)
+		} else if errorCheck(err) {
+			rcode = rcodeServFail
+		}
+	}
+	if rcode != rcodeNoError {
+		dns.queryDNSToRcode(rcode, z)
+	}
+	var limit = dns.edns.payloadLimit()
+	if tcp {
+		limit = maxTCPMessage
+	}
+	response, err := dns.dnsToBytes(limit)
 	if errorCheck(err) {
 		return nil
 	}
-	return packet
+	return response
 }
 
 // udpRecvsocket continuously listens for incoming udpPackets and sends them into the channel
-func udpRecvSocket(connection *net.UDPConn, recvPackets chan *udpPacket) {
-	// using 512 byte buffer as that is the max dns payload size
-	var packetBuffer = make([]byte, 512)
+// it stops and signals done when the socket is closed
+func udpRecvSocket(connection *net.UDPConn, recvPackets chan *udpPacket, done chan bool) {
+	// EDNS0 lets queries grow past 512 bytes, so read up to the largest udp payload
+	var packetBuffer = make([]byte, 65535)
 	for {
 		var length, addr, err = connection.ReadFromUDP(packetBuffer)
 		if errorCheck(err) {
-			close(recvPackets)
+			done <- true
 			return
 		}
 		if length > 0 {
-			recvPackets <- &udpPacket{packetBuffer[:length], *addr}
+			// the buffer is reused for the next read, so the packet gets its own copy
+			var body = append([]byte(nil), packetBuffer[:length]...)
+			recvPackets <- &udpPacket{body, *addr, connection}
 		}
 	}
 }
 
-// udpSendSocket continously listens for outgoing udpPackets and sends them through the socket
-func udpSendSocket(connection *net.UDPConn, sendPackets chan *udpPacket, done chan bool) {
-	for {
-		var packet = <-sendPackets
-		_, err := connection.WriteToUDP(packet.body, &(packet.addr))
-		if errorCheck(err) {
-			done <- true
-			return
+// udpWorker handles packets off the channel and writes the responses back through their sockets
+func udpWorker(recvPackets chan *udpPacket, zones *zoneTable, r *router) {
+	for packet := range recvPackets {
+		var response = handleRequest(packet, zones, r)
+		if response != nil {
+			_, err := response.connection.WriteToUDP(response.body, &(response.addr))
+			errorCheck(err)
 		}
 	}
 }
 
-// dnsServer starts up a dns server that listens for dns answer queries for name on port port
-func dnsServer(port int, name string) {
+// everything the dns server runs with, built from the command line in main
+type serverConfig struct {
+	port         int        // udp and tcp port queries are answered on, and of hosts that don't set their own
+	zones        *zoneTable // the zones answered for
+	hostsFile    string     // where the hosts are read from, reread on SIGHUP
+	registerPort int        // port replicas register themselves on, 0 if they can't
+	adminAddr    string     // address the admin api is served on, empty for none
+	explainTXT   bool       // whether _explain TXT queries are answered
+	geo          geolocator
+	policy       routingPolicy
+	rtts         *measurementStore
+	secret       []byte // shared with the hosts to authenticate their control channels
+	affinity     int    // hosts each name and path prefix is hashed to, 0 to leave content unhashed
+	workers      int    // threads handling udp queries, each with its own socket where the port can be shared
+}
+
+// dnsServer starts up a dns server that listens for dns answer queries for the config's zones on its port
+// each of the sockets gets a reader thread, and a pool of workers handles the packets they read
+// the hosts are read from the hosts file, and reread whenever the server gets a SIGHUP
+func dnsServer(config *serverConfig) {
 	var signals = make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// channels for sending and receiving packets
-	var sendPackets = make(chan *udpPacket, 1)
-	var recvPackets = make(chan *udpPacket, 1)
-	// done channel for sending packets
+	// packets waiting for a worker
+	var recvPackets = make(chan *udpPacket, packetQueueSize)
+	// done channel for listening sockets that fail
 	var done = make(chan bool, 1)
 
-	// starting up udp socket, read and write operations done in other threads
-	var connection, err = net.ListenUDP("udp4", &(net.UDPAddr{Port: port}))
+	// starting up dual stack udp sockets, one per worker where the platform can share the port
+	var connections, err = listenUDP(config.port, config.workers)
+	if errorCheck(err) {
+		return
+	}
+	for _, connection := range connections {
+		defer connection.Close()
+		go udpRecvSocket(connection, recvPackets, done)
+	}
+
+	// tcp listener on the same port for truncated responses and tcp only networks
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: config.port})
 	if errorCheck(err) {
 		return
 	}
-	defer connection.Close()
-	go udpSendSocket(connection, sendPackets, done)
-	go udpRecvSocket(connection, recvPackets)
+	defer listener.Close()
 
-	var router = router{}
-	err = router.init(port)
+	var router = &router{}
+	err = router.init(config)
 	if errorCheck(err) {
 		return
 	}
+	// hosts named by records may still register, so they are only a mistake without registration
+	if err = config.zones.checkHosts(router); errorCheck(err) && config.registerPort == 0 {
+		return
+	}
+	if config.registerPort != 0 {
+		registerListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: config.registerPort})
+		if errorCheck(err) {
+			return
+		}
+		defer registerListener.Close()
+		go registrationServer(registerListener, router, done)
+	}
+	if config.adminAddr != "" {
+		go adminServer(config.adminAddr, config.zones, router, done)
+	}
+	go tcpServer(listener, config.zones, router, done)
+	for i := 0; i < config.workers; i++ {
+		go udpWorker(recvPackets, config.zones, router)
+	}
 
 	for {
 		select {
 		case sig := <-signals:
-			fmt.Println("Caught signal: ", sig)
-			return
-		case <-done:
-			fmt.Println("done caught")
-			return
-		case packet, ok := <-recvPackets:
-			if !ok {
-				fmt.Println("Error in listening socket")
+			if sig != syscall.SIGHUP {
+				fmt.Println("Caught signal: ", sig)
 				return
 			}
-			var response = handleRequest(packet, name, router)
-			if response != nil {
-				sendPackets <- response
+			// an invalid hosts file is reported and the hosts already loaded keep serving
+			fmt.Println("Reloading hosts from", config.hostsFile)
+			if err = router.reload(); errorCheck(err) {
+				continue
 			}
-		default:
-			continue
+			// records may now name hosts that are gone, they answer from the rest of their pool
+			errorCheck(config.zones.checkHosts(router))
+		case <-done:
+			fmt.Println("Error in listening socket")
+			return
 		}
 	}
 }
@@ -374,24 +698,99 @@ func dnsServer(port int, name string) {
 func main() {
 	defer os.Exit(0)
 
-	// argument parsing, take in -p port and -n name
+	// argument parsing, take in -p port and -n name or -z zones file, optionally -ns name servers and answer ttls
 	var port = flag.Int("p", -1, "Port for dns server to bind on")
 	var name = flag.String("n", "", "Base domain name for dns server to serve results for")
+	var zonesFile = flag.String("z", "", "JSON file of zones and the names they serve, used instead of -n")
+	var nameservers = flag.String("ns", "", "Comma separated list of name servers as name=ip[=ip...] for the zone, defaults to ns1.<name> at the public addresses of this machine")
+	var minTTL = flag.Uint("ttl-min", 5, "Answer ttl in seconds for clients that are still being measured")
+	var maxTTL = flag.Uint("ttl-max", 300, "Answer ttl in seconds for clients with settled rtts to every server")
+	var answers = flag.Int("answers", 1, "Number of ranked servers to return in each A or AAAA answer")
+	var affinity = flag.Int("affinity", 0, "Number of nearby hosts each name and path prefix is hashed to so their caches specialize, 0 for none")
+	var workers = flag.Int("workers", runtime.NumCPU(), "Number of threads handling udp queries, each with its own socket")
+	var geoDir = flag.String("geo", "geo", "Directory holding the GeoLite blocks, locations and blocks6 csvs")
+	var hostsFile = flag.String("hosts", defaultHostsFile, "JSON file of the http servers to route clients to, reread on SIGHUP")
+	var registerPort = flag.Int("register-port", 0, "Port http servers register themselves with the dns server on, 0 to only use the hosts file")
+	var adminAddr = flag.String("admin", "", "Address to serve the admin api on, such as 127.0.0.1:8053, empty for none")
+	var explainTXT = flag.Bool("explain-txt", false, "Answer TXT queries for _explain.<name> and _explain6.<name> with how the client is routed")
+	var secretFile = flag.String("secret", "cdn.secret", "File holding the secret shared with the http servers")
+	var policySpec = flag.String("policy", defaultPolicy, "Comma separated routing policies tried in order, from geo, rtt, wrr, load, least-loaded and random")
+	var mmdbPath = flag.String("mmdb", "", "MaxMind DB file to geolocate with instead of the csvs, reloaded when it changes")
+	var prefix4 = flag.Int("prefix4", defaultPrefix4, "Prefix length ipv4 clients are grouped by for rtt measurements")
+	var prefix6 = flag.Int("prefix6", defaultPrefix6, "Prefix length ipv6 clients are grouped by for rtt measurements")
+	var halfLife = flag.Duration("rtt-half-life", defaultRTTHalfLife, "How long it takes an rtt measurement's weight to halve")
+	var maxPrefixes = flag.Int("rtt-max-prefixes", defaultMaxPrefixes, "Most client prefixes to keep rtts for, the least recently measured are evicted")
 	flag.Parse()
 	// checking for valid arguments
-	if *port == -1 || *name == "" {
+	if *port == -1 || (*name == "") == (*zonesFile == "") || *workers < 1 || *affinity < 0 {
 		var errMsg string
 		if *port == -1 {
 			errMsg += "Port number must be provided. "
 		}
-		if *name == "" {
-			errMsg += "Name must be provided as a non-empty string."
+		if *workers < 1 {
+			errMsg += "At least one worker is needed. "
+		}
+		if *affinity < 0 {
+			errMsg += "Affinity must not be negative. "
+		}
+		if (*name == "") == (*zonesFile == "") {
+			errMsg += "Exactly one of name or zones file must be provided as a non-empty string."
 		}
 		if errorCheck(errors.New(errMsg)) {
 			return
 		}
 	}
-	fmt.Println(*port, *name)
-	dnsServer(*port, *name)
+	var zones *zoneTable
+	var err error
+	if *zonesFile != "" {
+		zones, err = loadZones(*zonesFile, uint32(*minTTL), uint32(*maxTTL), *answers, *affinity)
+	} else {
+		// a single zone whose apex is routed to every host
+		var z *zone
+		z, err = newZone(*name, *nameservers, uint32(*minTTL), uint32(*maxTTL), *answers, *affinity)
+		if err == nil {
+			err = z.addRecord("@", nil, "")
+			zones = &zoneTable{[]*zone{z}}
+		}
+	}
+	if errorCheck(err) {
+		return
+	}
+	policy, err := parsePolicy(*policySpec)
+	if errorCheck(err) {
+		return
+	}
+	secret, err := protocol.LoadSecret(*secretFile)
+	if errorCheck(err) {
+		return
+	}
+	rtts, err := newMeasurementStore(*prefix4, *prefix6, *halfLife, *maxPrefixes)
+	if errorCheck(err) {
+		return
+	}
+	var geo geolocator
+	if *mmdbPath != "" {
+		geo, err = watchMMDB(*mmdbPath)
+	} else {
+		geo, err = loadGeoIndex(*geoDir)
+	}
+	if errorCheck(err) {
+		return
+	}
+	fmt.Println(*port, *name, *zonesFile)
+	dnsServer(&serverConfig{
+		port:         *port,
+		zones:        zones,
+		hostsFile:    *hostsFile,
+		registerPort: *registerPort,
+		adminAddr:    *adminAddr,
+		explainTXT:   *explainTXT,
+		geo:          geo,
+		policy:       policy,
+		rtts:         rtts,
+		secret:       secret,
+		affinity:     *affinity,
+		workers:      *workers,
+	})
 	fmt.Println("Exiting...")
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// a zone with an alias, a name below an empty non terminal and its glued name server, none of
+// whose queries below need the router to rank hosts
+func testZones(t *testing.T) *zoneTable {
+	var z, err = newZone("cdn.example.com", "ns1.cdn.example.com=192.0.2.53", 5, 300, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []struct{ name, cname string }{{"@", ""}, {"a.b", ""}, {"www", "cdn.example.com"}} {
+		if err := z.addRecord(record.name, nil, record.cname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &zoneTable{[]*zone{z}}
+}
+
+// testQuery serializes a query for name, additional can hold an OPT record
+func testQuery(t *testing.T, name string, qtype, qclass uint16, opcode uint8, additional ...*dnsRecord) []byte {
+	var query = &dnsPacket{id: 0xBEEF, opcode: opcode, rd: true, additional: additional}
+	if name != "" {
+		query.question = &dnsQuestion{domainToByteArrays(name), qtype, qclass}
+	}
+	body, err := query.writeToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// every query gets an answer, with the rcode, flags and authority section telling resolvers why
+func TestQueryRcodes(t *testing.T) {
+	var zones = testZones(t)
+	var badVersion = &dnsRecord{nil, typeOPT, 1232, 1 << 16, optRdata{}}
+	var tests = []struct {
+		name      string
+		query     []byte
+		rcode     uint8
+		aa        bool
+		answers   int
+		authority int // the zone's SOA for negative answers
+	}{
+		{"apex soa", testQuery(t, "cdn.example.com", typeSOA, classIN, 0), rcodeNoError, true, 1, 1},
+		{"alias", testQuery(t, "WWW.cdn.example.com", typeCNAME, classIN, 0), rcodeNoError, true, 1, 0},
+		{"glue", testQuery(t, "ns1.cdn.example.com", typeA, classIN, 0), rcodeNoError, true, 1, 0},
+		{"missing name", testQuery(t, "nope.cdn.example.com", typeA, classIN, 0), rcodeNXDomain, true, 0, 1},
+		{"below a missing name", testQuery(t, "x.nope.cdn.example.com", typeAAAA, classIN, 0), rcodeNXDomain, true, 0, 1},
+		{"missing type", testQuery(t, "cdn.example.com", 15, classIN, 0), rcodeNoError, true, 0, 1},
+		{"empty non terminal", testQuery(t, "b.cdn.example.com", typeA, classIN, 0), rcodeNoError, true, 0, 1},
+		{"name server without ipv6", testQuery(t, "ns1.cdn.example.com", typeAAAA, classIN, 0), rcodeNoError, true, 0, 1},
+		{"class any", testQuery(t, "cdn.example.com", typeSOA, classANY, 0), rcodeNoError, true, 1, 1},
+		{"other zone", testQuery(t, "example.org", typeA, classIN, 0), rcodeRefused, false, 0, 0},
+		{"parent of the zone", testQuery(t, "example.com", typeA, classIN, 0), rcodeRefused, false, 0, 0},
+		{"chaos class", testQuery(t, "cdn.example.com", typeA, 3, 0), rcodeRefused, false, 0, 0},
+		{"status opcode", testQuery(t, "cdn.example.com", typeA, classIN, 2), rcodeNotImp, false, 0, 0},
+		{"update opcode", testQuery(t, "cdn.example.com", typeSOA, classIN, 5), rcodeNotImp, false, 0, 0},
+		{"no question", testQuery(t, "", 0, 0, 0), rcodeFormErr, false, 0, 0},
+		{"truncated question", testQuery(t, "cdn.example.com", typeA, classIN, 0)[:20], rcodeFormErr, false, 0, 0},
+		{"edns version 1", testQuery(t, "cdn.example.com", typeA, classIN, 0, badVersion), rcodeBadVers, false, 0, 0},
+	}
+	for _, test := range tests {
+		var body = handleQuery(test.query, net.ParseIP("8.8.8.8"), false, zones, &router{})
+		if body == nil {
+			t.Errorf("%s: no response", test.name)
+			continue
+		}
+		var response = &dnsPacket{}
+		if err := response.parseDNS(body); err != nil {
+			t.Errorf("%s: response doesn't parse: %v", test.name, err)
+			continue
+		}
+		if !response.qr || response.id != 0xBEEF || !response.rd {
+			t.Errorf("%s: qr %v, id %x, rd %v, want a response to the query", test.name, response.qr, response.id, response.rd)
+		}
+		if response.rcode != test.rcode || response.aa != test.aa {
+			t.Errorf("%s: rcode %d, aa %v, want %d, %v", test.name, response.rcode, response.aa, test.rcode, test.aa)
+		}
+		if len(response.answers) != test.answers || len(response.authority) != test.authority {
+			t.Errorf("%s: %d answers and %d authority records, want %d and %d", test.name,
+				len(response.answers), len(response.authority), test.answers, test.authority)
+		} else if test.answers == 0 && test.authority == 1 && response.authority[0].rtype != typeSOA {
+			t.Errorf("%s: negative answer carries a record of type %d, want the SOA", test.name, response.authority[0].rtype)
+		}
+	}
+}
+
+// messages that are responses or too short for a header are dropped rather than answered
+func TestQueryDropped(t *testing.T) {
+	var zones = testZones(t)
+	var response = testQuery(t, "cdn.example.com", typeA, classIN, 0)
+	response[2] |= 0x80
+	for _, body := range [][]byte{response, {0xBE, 0xEF, 1, 0}, nil} {
+		if answer := handleQuery(body, net.ParseIP("8.8.8.8"), false, zones, &router{}); answer != nil {
+			t.Errorf("answered % x with % x", body, answer)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// the OPT pseudo record type used by EDNS0
+const typeOPT uint16 = 41
+
+// udp payload sizes, responses to clients without EDNS0 must fit the classic 512 bytes
+const (
+	minUDPPayload uint16 = 512
+	maxUDPPayload uint16 = 4096
+)
+
+// extended rcode for queries using an EDNS version we don't speak
+const rcodeBadVers uint8 = 16
+
+// the EDNS Client Subnet option code and its address families
+const (
+	optionClientSubnet uint16 = 8
+	familyIPv4         uint16 = 1
+	familyIPv6         uint16 = 2
+)
+
+// the EDNS0 information carried in an OPT record
+type ednsOpt struct {
+	udpSize uint16 // largest udp payload the sender can reassemble
+	version uint8
+	do      bool // dnssec ok
+	options []ednsOption
+	subnet  *clientSubnet // nil if the query had no client subnet option
+}
+
+// the end user's subnet as sent by a recursive resolver in the client subnet option
+type clientSubnet struct {
+	family       uint16
+	sourcePrefix uint8
+	scopePrefix  uint8 // how much of the subnet our answer applies to, set when answering
+	ip           net.IP
+}
+
+// a single EDNS0 option
+type ednsOption struct {
+	code uint16
+	data []byte
+}
+
+// the rdata of an OPT record, a list of options
+type optRdata []ednsOption
+
+// extractEDNS removes the OPT record from the packet's additional section and parses it
+// the extended rcode bits of the OPT record are merged into the packet's rcode
+func (packet *dnsPacket) extractEDNS() error {
+	var additional = make([]*dnsRecord, 0, len(packet.additional))
+	for _, record := range packet.additional {
+		if record.rtype != typeOPT {
+			additional = append(additional, record)
+			continue
+		} else if packet.edns != nil {
+			return errors.New("More than one OPT record in packet")
+		} else if len(record.name) != 0 {
+			return errors.New("OPT record must be owned by the root domain")
+		}
+		raw, ok := record.rdata.(rawRdata)
+		if !ok {
+			return errors.New("OPT record data was not read from the wire")
+		}
+		options, err := parseEDNSOptions(raw)
+		if err != nil {
+			return err
+		}
+		packet.rcode += uint8(record.ttl>>24) << 4
+		packet.edns = &ednsOpt{
+			udpSize: record.class,
+			version: uint8(record.ttl >> 16),
+			do:      record.ttl&0x8000 != 0,
+			options: options}
+		for _, option := range options {
+			if option.code != optionClientSubnet {
+				continue
+			} else if packet.edns.subnet != nil {
+				return errors.New("More than one client subnet option in OPT record")
+			}
+			if packet.edns.subnet, err = parseClientSubnet(option.data); err != nil {
+				return err
+			}
+		}
+	}
+	packet.additional = additional
+	return nil
+}
+
+// parseEDNSOptions splits OPT record data into its code, length, data options
+func parseEDNSOptions(raw []byte) ([]ednsOption, error) {
+	var result []ednsOption
+	for len(raw) > 0 {
+		if len(raw) < 4 {
+			return nil, errors.New("Truncated EDNS option header")
+		}
+		var code = binary.BigEndian.Uint16(raw)
+		var length = int(binary.BigEndian.Uint16(raw[2:]))
+		if len(raw) < 4+length {
+			return nil, errors.New("EDNS option length is longer than the OPT record")
+		}
+		result = append(result, ednsOption{code, raw[4 : 4+length]})
+		raw = raw[4+length:]
+	}
+	return result, nil
+}
+
+// parseClientSubnet parses the data of a client subnet option as described in rfc 7871
+func parseClientSubnet(data []byte) (*clientSubnet, error) {
+	if len(data) < 4 {
+		return nil, errors.New("Truncated client subnet option")
+	}
+	var subnet = &clientSubnet{
+		family:       binary.BigEndian.Uint16(data),
+		sourcePrefix: data[2],
+		scopePrefix:  data[3]}
+	var addressLength int
+	switch subnet.family {
+	case familyIPv4:
+		addressLength = net.IPv4len
+	case familyIPv6:
+		addressLength = net.IPv6len
+	default:
+		return nil, errors.New("Unknown client subnet address family")
+	}
+	var address = data[4:]
+	if int(subnet.sourcePrefix) > addressLength*8 {
+		return nil, errors.New("Client subnet source prefix is longer than the address")
+	} else if subnet.scopePrefix != 0 {
+		return nil, errors.New("Client subnet scope prefix must be 0 in queries")
+	} else if len(address) != (int(subnet.sourcePrefix)+7)/8 {
+		return nil, errors.New("Client subnet address length does not match the source prefix")
+	}
+	var ip = make(net.IP, addressLength)
+	copy(ip, address)
+	var mask = net.CIDRMask(int(subnet.sourcePrefix), addressLength*8)
+	if !ip.Mask(mask).Equal(ip) {
+		return nil, errors.New("Client subnet address has bits set past the source prefix")
+	}
+	subnet.ip = ip
+	return subnet, nil
+}
+
+// clientIP returns the address routing should be done for, the resolver's own address unless
+// the resolver told us which subnet its client is in
+// the subnet is represented by its first host address so it can be geolocated and pinged,
+// private and reserved subnets can be neither, so the resolver's address is used for them
+func (edns *ednsOpt) clientIP(resolver net.IP) net.IP {
+	if edns == nil || edns.subnet == nil || edns.subnet.sourcePrefix == 0 {
+		return resolver
+	}
+	var ip = append(net.IP(nil), edns.subnet.ip...)
+	if int(edns.subnet.sourcePrefix) < len(ip)*8 {
+		ip[len(ip)-1] |= 1
+	}
+	if edns.subnet.family == familyIPv4 {
+		ip = ip.To16()
+	}
+	if !publicAddress(ip) {
+		return resolver
+	}
+	return ip
+}
+
+// scopeToSource marks the answer as tailored to the whole client subnet the resolver sent,
+// answers for subnets that were ignored keep a scope of 0 and hold for any client of the resolver
+func (edns *ednsOpt) scopeToSource() {
+	if edns != nil && edns.subnet != nil && publicAddress(edns.subnet.ip) {
+		edns.subnet.scopePrefix = edns.subnet.sourcePrefix
+	}
+}
+
+// toOption serializes the client subnet back into an option for the response
+func (subnet *clientSubnet) toOption() ednsOption {
+	var data = binary.BigEndian.AppendUint16(nil, subnet.family)
+	data = append(data, subnet.sourcePrefix, subnet.scopePrefix)
+	data = append(data, subnet.ip[:(int(subnet.sourcePrefix)+7)/8]...)
+	return ednsOption{optionClientSubnet, data}
+}
+
+// payloadLimit returns the largest udp response the client accepts, capped to what we are willing to send
+func (edns *ednsOpt) payloadLimit() int {
+	if edns == nil || edns.udpSize < minUDPPayload {
+		return int(minUDPPayload)
+	} else if edns.udpSize > maxUDPPayload {
+		return int(maxUDPPayload)
+	}
+	return int(edns.udpSize)
+}
+
+// response builds the OPT record answering this one
+// we advertise our own payload size and carry the upper bits of rcode
+// client subnet is the only option we implement, so it is the only one answered, with the scope prefix
+// of our answer, other options such as cookies must not be echoed back (RFC 6891 section 6.1.2)
+func (edns *ednsOpt) response(rcode uint8) *dnsRecord {
+	var ttl = uint32(rcode>>4) << 24
+	if edns.do {
+		ttl |= 0x8000
+	}
+	var options = make(optRdata, 0, 1)
+	if edns.subnet != nil {
+		options = append(options, edns.subnet.toOption())
+	}
+	return &dnsRecord{nil, typeOPT, maxUDPPayload, ttl, options}
+}
+
+func (options optRdata) writeTo(writer *dnsWriter) error {
+	for _, option := range options {
+		if len(option.data) > 0xFFFF {
+			return errors.New("EDNS option too long")
+		}
+		writer.writeUint16(option.code)
+		writer.writeUint16(uint16(len(option.data)))
+		writer.writeBytes(option.data)
+	}
+	return nil
+}
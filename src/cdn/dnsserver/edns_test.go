@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// option builds the wire form of a single EDNS option
+func option(code uint16, data ...byte) []byte {
+	return append([]byte{byte(code >> 8), byte(code), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+// the OPT record is taken out of the additional section and its fields read from the class and ttl
+func TestExtractEDNS(t *testing.T) {
+	var glue = &dnsRecord{domainToByteArrays("ns1.cdn.example.com"), typeA, classIN, 60, rawRdata{192, 0, 2, 53}}
+	var tests = []struct {
+		name       string
+		additional []*dnsRecord
+		fail       bool
+		udpSize    uint16
+		version    uint8
+		do         bool
+		options    int
+		rcode      uint8 // the extended rcode bits merged with the header's
+	}{
+		{"plain", []*dnsRecord{{nil, typeOPT, 1232, 0, rawRdata{}}}, false, 1232, 0, false, 0, 0},
+		{"dnssec ok", []*dnsRecord{{nil, typeOPT, 4096, 0x8000, rawRdata{}}}, false, 4096, 0, true, 0, 0},
+		{"version and extended rcode", []*dnsRecord{{nil, typeOPT, 512, 1<<24 | 1<<16, rawRdata{}}}, false, 512, 1, false, 0, 16},
+		{"cookie and padding", []*dnsRecord{{nil, typeOPT, 1232, 0, rawRdata(append(option(10, 1, 2, 3, 4, 5, 6, 7, 8), option(12, 0, 0)...))}},
+			false, 1232, 0, false, 2, 0},
+		{"after glue", []*dnsRecord{glue, {nil, typeOPT, 1400, 0, rawRdata{}}}, false, 1400, 0, false, 0, 0},
+		{"two opt records", []*dnsRecord{{nil, typeOPT, 1232, 0, rawRdata{}}, {nil, typeOPT, 1232, 0, rawRdata{}}}, true, 0, 0, false, 0, 0},
+		{"owned by a name", []*dnsRecord{{domainToByteArrays("example.com"), typeOPT, 1232, 0, rawRdata{}}}, true, 0, 0, false, 0, 0},
+		{"truncated option header", []*dnsRecord{{nil, typeOPT, 1232, 0, rawRdata{0, 10, 0}}}, true, 0, 0, false, 0, 0},
+		{"option past the record", []*dnsRecord{{nil, typeOPT, 1232, 0, rawRdata{0, 10, 0, 8, 1, 2}}}, true, 0, 0, false, 0, 0},
+	}
+	for _, test := range tests {
+		var packet = &dnsPacket{additional: test.additional}
+		var err = packet.extractEDNS()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: parsed, want an error", test.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var edns = packet.edns
+		if edns.udpSize != test.udpSize || edns.version != test.version || edns.do != test.do || len(edns.options) != test.options {
+			t.Errorf("%s: got size %d, version %d, do %v, %d options", test.name, edns.udpSize, edns.version, edns.do, len(edns.options))
+		}
+		if packet.rcode != test.rcode {
+			t.Errorf("%s: rcode %d, want %d", test.name, packet.rcode, test.rcode)
+		}
+		if len(packet.additional) != len(test.additional)-1 {
+			t.Errorf("%s: %d additional records left, want only the OPT taken out", test.name, len(packet.additional))
+		}
+	}
+}
+
+// udp responses are capped to the size the client advertised, within the classic 512 and our 4096
+func TestPayloadLimit(t *testing.T) {
+	var tests = []struct {
+		edns  *ednsOpt
+		limit int
+	}{
+		{nil, 512},
+		{&ednsOpt{udpSize: 0}, 512},
+		{&ednsOpt{udpSize: 100}, 512},
+		{&ednsOpt{udpSize: 1232}, 1232},
+		{&ednsOpt{udpSize: 4096}, 4096},
+		{&ednsOpt{udpSize: 65535}, 4096},
+	}
+	for _, test := range tests {
+		if limit := test.edns.payloadLimit(); limit != test.limit {
+			t.Errorf("payloadLimit(%v) = %d, want %d", test.edns, limit, test.limit)
+		}
+	}
+}
+
+// responses that don't fit are sent without records and with tc set, keeping the OPT so the client
+// still learns our payload size
+func TestTruncation(t *testing.T) {
+	var owner = domainToByteArrays("cdn.example.com")
+	var answers []*dnsRecord
+	for i := 0; i < 40; i++ {
+		answers = append(answers, &dnsRecord{owner, typeAAAA, classIN, 60, rawRdata(net.ParseIP("2001:db8::1"))})
+	}
+	var tests = []struct {
+		edns  *ednsOpt
+		limit int
+		tc    bool
+	}{
+		{nil, 512, true},
+		{&ednsOpt{udpSize: 1232}, 1232, false},
+		{&ednsOpt{udpSize: 512}, 512, true},
+		{nil, maxTCPMessage, false},
+	}
+	for _, test := range tests {
+		var packet = &dnsPacket{id: 1, qr: true, question: &dnsQuestion{owner, typeAAAA, classIN}, answers: answers, edns: test.edns}
+		body, err := packet.dnsToBytes(test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response = &dnsPacket{}
+		if err := response.parseDNS(body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body) > test.limit || response.tc != test.tc {
+			t.Errorf("limit %d: %d bytes, tc %v, want tc %v", test.limit, len(body), response.tc, test.tc)
+		}
+		if test.tc && len(response.answers) != 0 || !test.tc && len(response.answers) != len(answers) {
+			t.Errorf("limit %d: %d answers", test.limit, len(response.answers))
+		}
+		if (response.edns != nil) != (test.edns != nil) {
+			t.Errorf("limit %d: OPT in response %v, want %v", test.limit, response.edns != nil, test.edns != nil)
+		}
+	}
+}
+
+// the OPT record of a response advertises our payload size, keeps the DO bit and echoes no option
+// other than client subnet
+func TestEDNSResponse(t *testing.T) {
+	var query = &dnsPacket{additional: []*dnsRecord{{nil, typeOPT, 1232, 0x8000, rawRdata(option(10, 1, 2, 3, 4, 5, 6, 7, 8))}}}
+	if err := query.extractEDNS(); err != nil {
+		t.Fatal(err)
+	}
+	var opt = query.edns.response(rcodeBadVers)
+	if opt.class != maxUDPPayload || opt.ttl != 1<<24|0x8000 {
+		t.Errorf("OPT class %d, ttl %x", opt.class, opt.ttl)
+	}
+	var writer = newDNSWriter(64)
+	if err := opt.rdata.writeTo(writer); err != nil || !bytes.Equal(writer.buf, []byte{}) {
+		t.Errorf("OPT data % x, %v, want no options", writer.buf, err)
+	}
+}
+
+// client subnet options must be well formed, with the address cut to the source prefix (rfc 7871 section 7.1)
+func TestParseClientSubnet(t *testing.T) {
+	var tests = []struct {
+		name   string
+		data   []byte
+		fail   bool
+		source uint8
+		ip     string
+	}{
+		{"ipv4 /24", []byte{0, 1, 24, 0, 198, 51, 100}, false, 24, "198.51.100.0"},
+		{"ipv4 /20", []byte{0, 1, 20, 0, 198, 51, 96}, false, 20, "198.51.96.0"},
+		{"ipv4 /32", []byte{0, 1, 32, 0, 8, 8, 8, 8}, false, 32, "8.8.8.8"},
+		{"ipv4 /0", []byte{0, 1, 0, 0}, false, 0, "0.0.0.0"},
+		{"ipv6 /56", []byte{0, 2, 56, 0, 0x26, 0x00, 0x1f, 0x18, 0, 0, 0x42}, false, 56, "2600:1f18:0:4200::"},
+		{"truncated", []byte{0, 1, 24}, true, 0, ""},
+		{"unknown family", []byte{0, 3, 8, 0, 1}, true, 0, ""},
+		{"source past the address", []byte{0, 1, 33, 0, 1, 2, 3, 4, 5}, true, 0, ""},
+		{"scope set in a query", []byte{0, 1, 24, 24, 198, 51, 100}, true, 0, ""},
+		{"address longer than the prefix", []byte{0, 1, 24, 0, 198, 51, 100, 0}, true, 0, ""},
+		{"address shorter than the prefix", []byte{0, 1, 24, 0, 198, 51}, true, 0, ""},
+		{"bits past the prefix", []byte{0, 1, 20, 0, 198, 51, 100}, true, 0, ""},
+	}
+	for _, test := range tests {
+		var subnet, err = parseClientSubnet(test.data)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: parsed %v, want an error", test.name, subnet)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if subnet.sourcePrefix != test.source || !subnet.ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s: got %s/%d, want %s/%d", test.name, subnet.ip, subnet.sourcePrefix, test.ip, test.source)
+		}
+		if option := subnet.toOption(); option.code != optionClientSubnet || !bytes.Equal(option.data, test.data) {
+			t.Errorf("%s: echoed as % x, want % x", test.name, option.data, test.data)
+		}
+	}
+}
+
+// routing uses a host inside the client's subnet when it is public, and the resolver otherwise,
+// and only answers routed on the subnet claim it as their scope
+func TestClientSubnetRouting(t *testing.T) {
+	var resolver = net.ParseIP("8.8.8.8")
+	var tests = []struct {
+		name   string
+		data   []byte // nil for a query without the option
+		client string
+		scope  uint8
+	}{
+		{"no option", nil, "8.8.8.8", 0},
+		{"ipv4 /24", []byte{0, 1, 24, 0, 81, 2, 69}, "81.2.69.1", 24},
+		{"ipv4 /32", []byte{0, 1, 32, 0, 1, 1, 1, 1}, "1.1.1.1", 32},
+		{"ipv6 /48", []byte{0, 2, 48, 0, 0x26, 0x00, 0x1f, 0x18, 0, 0x42}, "2600:1f18:42::1", 48},
+		{"source of 0", []byte{0, 1, 0, 0}, "8.8.8.8", 0},
+		{"private subnet", []byte{0, 1, 24, 0, 10, 1, 2}, "8.8.8.8", 0},
+		{"documentation subnet", []byte{0, 1, 24, 0, 192, 0, 2}, "8.8.8.8", 0},
+		{"unique local subnet", []byte{0, 2, 16, 0, 0xfd, 0}, "8.8.8.8", 0},
+	}
+	for _, test := range tests {
+		var edns = &ednsOpt{udpSize: 1232}
+		if test.data != nil {
+			var err error
+			if edns.subnet, err = parseClientSubnet(test.data); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if client := edns.clientIP(resolver); !client.Equal(net.ParseIP(test.client)) {
+			t.Errorf("%s: routed for %s, want %s", test.name, client, test.client)
+		}
+		edns.scopeToSource()
+		if edns.subnet != nil && edns.subnet.scopePrefix != test.scope {
+			t.Errorf("%s: scope %d, want %d", test.name, edns.subnet.scopePrefix, test.scope)
+		}
+	}
+	// answers that don't depend on the client, such as NXDOMAIN, keep a scope of 0
+	var query = testQuery(t, "nope.cdn.example.com", typeA, classIN, 0,
+		&dnsRecord{nil, typeOPT, 1232, 0, rawRdata(option(optionClientSubnet, 0, 1, 24, 0, 81, 2, 69))})
+	var response = &dnsPacket{}
+	if err := response.parseDNS(handleQuery(query, resolver, false, testZones(t), &router{})); err != nil {
+		t.Fatal(err)
+	}
+	if response.edns == nil || response.edns.subnet == nil || response.edns.subnet.scopePrefix != 0 ||
+		response.edns.subnet.sourcePrefix != 24 {
+		t.Errorf("NXDOMAIN answer carries client subnet %v, want it echoed with a scope of 0", response.edns)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leading labels of the TXT queries that explain how the rest of the name is routed over ipv4 and ipv6
+const (
+	explainLabel  string = "_explain."
+	explainLabel6 string = "_explain6."
+)
+
+// longest a TXT character string can be
+const maxTXTString int = 255
+
+// how long the admin api waits on a slow client
+const adminTimeout = 10 * time.Second
+
+// why a client is sent where it is, the client's location, every host and how routing ranked them
+type explanation struct {
+	Client     string          `json:"client"`
+	Prefix     string          `json:"prefix"`             // the client network rtts are kept for
+	Location   *explainedPoint `json:"location"`           // nil when the client can't be geolocated
+	Name       string          `json:"name,omitempty"`     // the routed name, after following an alias
+	IPv6       bool            `json:"ipv6"`               // whether this is the routing for AAAA queries
+	Answers    []string        `json:"answers"`            // what the client would be handed, best first
+	Policy     string          `json:"policy"`             // what decided the first answer
+	Fallback   string          `json:"fallback,omitempty"` // set when hosts that are down or draining are handed out
+	Confidence float64         `json:"confidence"`         // how settled the routing is, which scales the ttl
+	Hosts      []explainedHost `json:"hosts"`              // candidates in ranked order, then the hosts left out
+}
+
+type explainedPoint struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// a host as routing saw it for the client
+type explainedHost struct {
+	Address     string   `json:"address"`
+	ID          string   `json:"id"`
+	Region      string   `json:"region,omitempty"`
+	Distance    float64  `json:"distance_km"`
+	RTT         *float64 `json:"rtt_ms,omitempty"` // time decayed average rtt to the client's prefix
+	RTTWeight   float64  `json:"rtt_weight,omitempty"`
+	RTTSamples  int      `json:"rtt_samples,omitempty"`
+	Utilization *float64 `json:"utilization,omitempty"` // share of the load over share of the capacity, 1 is fair
+	Up          bool     `json:"up"`
+	Draining    bool     `json:"draining"`
+	RankedBy    string   `json:"ranked_by,omitempty"` // the policy that placed the host, empty if it was left out
+	Excluded    string   `json:"excluded,omitempty"`  // why the host wasn't a candidate
+}
+
+// explain routes the client the way getServers does and records why, without asking hosts to measure it
+// stateful policies only peek, so explaining a decision never changes the next one
+func (r *router) explain(ip string, ipv6 bool, n int, pool []string, affinity affinity) *explanation {
+	r.hostsMutex.RLock()
+	defer r.hostsMutex.RUnlock()
+	var client = net.ParseIP(ip)
+	var result = &explanation{Client: ip, IPv6: ipv6, Name: affinity.key, Prefix: r.rtts.prefixOf(client).String()}
+	var loc, located = r.geo.lookup(client)
+	if located {
+		result.Location = &explainedPoint{loc.lat, loc.long}
+	}
+
+	var candidates, excluded = r.candidates(ipv6, pool)
+	var rankedBy = make(map[string]string, len(candidates))
+	var ranked []string
+	if chain, ok := r.policy.(chainPolicy); ok {
+		ranked = chain.rankBy(r, ip, candidates, rankedBy, true)
+	} else {
+		if stateful, ok := r.policy.(statefulPolicy); ok {
+			ranked = stateful.peek(r, ip, candidates)
+		} else {
+			ranked = r.policy.rank(r, ip, candidates)
+		}
+		for _, server := range ranked {
+			rankedBy[server] = r.policy.name()
+		}
+	}
+	var withAffinity = affinity.apply(ranked)
+	var final = r.preferSpare(withAffinity)
+	switch {
+	case len(final) == 0:
+		result.Policy = "none, no host in the pool can serve the address family"
+	case final[0] != withAffinity[0]:
+		result.Policy = "load, " + withAffinity[0] + " carries well over its share"
+	case withAffinity[0] != ranked[0]:
+		result.Policy = "affinity, the name hashes to " + final[0] + " among the nearby hosts"
+	default:
+		result.Policy = rankedBy[final[0]]
+	}
+	if len(final) > 0 && r.hosts[final[0]].draining.Load() {
+		result.Fallback = "every host in the pool is draining"
+	} else if len(final) > 0 && !r.hosts[final[0]].up.Load() {
+		result.Fallback = "every host in the pool is down"
+	}
+	result.Answers = final[:min(n, len(final))]
+
+	var utilization = r.utilization(candidates)
+	var describe = func(server string) explainedHost {
+		var h = r.hosts[server]
+		var described = explainedHost{Address: server, ID: h.id, Region: h.region,
+			Distance: distance(loc, h.loc) / 1000, Up: h.up.Load(), Draining: h.draining.Load(),
+			RankedBy: rankedBy[server], Excluded: excluded[server]}
+		if !located {
+			described.Distance = 0
+		}
+		if rtt, in := r.rtts.estimate(client, server); in {
+			described.RTT, described.RTTWeight, described.RTTSamples = &rtt.avg, rtt.weight, rtt.samples
+		}
+		if share, in := utilization[server]; in {
+			described.Utilization = &share
+		}
+		return described
+	}
+	for _, server := range final {
+		result.Hosts = append(result.Hosts, describe(server))
+	}
+	var others = make([]string, 0, len(excluded))
+	for server := range excluded {
+		others = append(others, server)
+	}
+	sort.Strings(others)
+	for _, server := range others {
+		result.Hosts = append(result.Hosts, describe(server))
+	}
+	return result
+}
+
+// explainName explains the routing of a name found by routedName, along with the confidence its ttl is scaled by
+func (r *router) explainName(ip string, ipv6 bool, z *zone, record *zoneRecord, owner string) *explanation {
+	var result = r.explain(ip, ipv6, z.answers, record.hosts, affinity{owner, z.affinity})
+	result.Name = owner
+	result.Confidence = r.confidence(ip, ipv6, record.hosts)
+	return result
+}
+
+// routedName returns the zone and record domain is routed by, following an alias to one of our own names
+// along with the name it is routed as
+func (table *zoneTable) routedName(domain string) (*zone, *zoneRecord, string, error) {
+	var z = table.find(domain)
+	if z == nil {
+		return nil, nil, "", errors.New("Name " + domain + " is not in any zone")
+	}
+	var record = z.lookup(domain)
+	if record != nil && record.cname != "" {
+		domain = record.cname
+		if z = table.find(domain); z == nil {
+			return nil, nil, "", errors.New("Name is an alias for " + domain + " which is not in any zone")
+		}
+		record = z.lookup(domain)
+	}
+	if record == nil || record.cname != "" || z.getNameserver(domain) != nil {
+		return nil, nil, "", errors.New("Name " + domain + " is not routed")
+	}
+	return z, record, domain, nil
+}
+
+// lines formats the explanation as TXT character strings, one for the client and the decision
+// and one per host, each cut to the longest a character string can be
+func (e *explanation) lines() []string {
+	var location = "unknown location"
+	if e.Location != nil {
+		location = strconv.FormatFloat(e.Location.Lat, 'f', 2, 64) + "," + strconv.FormatFloat(e.Location.Long, 'f', 2, 64)
+	}
+	var lines = []string{
+		"client " + e.Client + " in " + e.Prefix + " at " + location,
+		"answers " + strings.Join(e.Answers, ",") + " decided by " + e.Policy + " confidence " + strconv.FormatFloat(e.Confidence, 'f', 2, 64),
+	}
+	if e.Fallback != "" {
+		lines = append(lines, "fallback "+e.Fallback)
+	}
+	for _, h := range e.Hosts {
+		var line = h.Address + " id=" + h.ID
+		if h.Region != "" {
+			line += " region=" + h.Region
+		}
+		if h.Excluded != "" {
+			line += " excluded=" + strings.ReplaceAll(h.Excluded, " ", "_")
+		} else {
+			line += " ranked_by=" + h.RankedBy
+		}
+		line += fmt.Sprintf(" up=%v draining=%v distance_km=%.0f", h.Up, h.Draining, h.Distance)
+		if h.RTT != nil {
+			line += fmt.Sprintf(" rtt_ms=%.1f rtt_samples=%d rtt_weight=%.2f", *h.RTT, h.RTTSamples, h.RTTWeight)
+		}
+		if h.Utilization != nil {
+			line += fmt.Sprintf(" utilization=%.2f", *h.Utilization)
+		}
+		lines = append(lines, line)
+	}
+	for i, line := range lines {
+		if len(line) > maxTXTString {
+			lines[i] = line[:maxTXTString]
+		}
+	}
+	return lines
+}
+
+// explainedDomain returns the name an _explain TXT query is about and whether it asks about ipv6,
+// ok is false for every other query
+func explainedDomain(domain string) (target string, ipv6 bool, ok bool) {
+	if strings.HasPrefix(domain, explainLabel) {
+		return strings.TrimPrefix(domain, explainLabel), false, true
+	} else if strings.HasPrefix(domain, explainLabel6) {
+		return strings.TrimPrefix(domain, explainLabel6), true, true
+	}
+	return "", false, false
+}
+
+// explainRecords answers an _explain TXT query with how the client is routed for the name after the label
+// the answer has a ttl of 0 so resolvers don't hand it to other clients
+func (packet *dnsPacket) explainRecords(domain string, ip net.IP, zones *zoneTable, r *router) ([]*dnsRecord, error) {
+	var target, ipv6, _ = explainedDomain(domain)
+	z, record, owner, err := zones.routedName(target)
+	if err != nil {
+		return nil, errNXDomain
+	}
+	var explanation = r.explainName(ip.String(), ipv6, z, record, owner)
+	return []*dnsRecord{{packet.question.qname, typeTXT, classIN, 0, txtRdata(explanation.lines())}}, nil
+}
+
+// adminServer serves the admin api on addr until it fails, then signals done
+// GET /explain?name=<name>&client=<ip>&type=<A or AAAA> explains how the client is routed for the name,
+// the client defaults to the caller and the type to A
+func adminServer(addr string, zones *zoneTable, r *router, done chan bool) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, req *http.Request) {
+		var query = req.URL.Query()
+		var client = net.ParseIP(query.Get("client"))
+		if query.Get("client") == "" {
+			host, _, _ := net.SplitHostPort(req.RemoteAddr)
+			client = net.ParseIP(host)
+		}
+		var qtype = strings.ToUpper(query.Get("type"))
+		if client == nil {
+			http.Error(w, "Bad client address "+query.Get("client"), http.StatusBadRequest)
+			return
+		} else if qtype != "" && qtype != "A" && qtype != "AAAA" {
+			http.Error(w, "Type must be A or AAAA", http.StatusBadRequest)
+			return
+		}
+		z, record, owner, err := zones.routedName(strings.TrimSuffix(strings.ToLower(query.Get("name")), "."))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		var encoder = json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		errorCheck(encoder.Encode(r.explainName(client.String(), qtype == "AAAA", z, record, owner)))
+	})
+	var server = &http.Server{Addr: addr, Handler: mux, ReadTimeout: adminTimeout, WriteTimeout: adminTimeout}
+	errorCheck(server.ListenAndServe())
+	done <- true
+}
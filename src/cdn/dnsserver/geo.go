@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the GeoLite city csvs loaded from the geolocation directory
+const (
+	geoBlocksFile    string = "blocks.csv"    // startIpNum,endIpNum,locId
+	geoLocationsFile string = "locations.csv" // locId,country,region,city,postalCode,latitude,longitude,metroCode,areaCode
+	geoBlocks6File   string = "blocks6.csv"   // startIp,endIp,startNum,endNum,country,region,city,postalCode,latitude,longitude,...
+)
+
+// geolocator finds where an ip address is, ok is false if it doesn't know
+type geolocator interface {
+	lookup(ip net.IP) (loc latLong, ok bool)
+}
+
+// a range of ipv4 addresses and where they are
+type geoRange4 struct {
+	start uint32
+	end   uint32
+	loc   latLong
+}
+
+// a range of ipv6 addresses and where they are
+type geoRange6 struct {
+	start [net.IPv6len]byte
+	end   [net.IPv6len]byte
+	loc   latLong
+}
+
+// in memory geolocation tables, each sorted by start address so lookups are a binary search
+type geoIndex struct {
+	ranges4 []geoRange4
+	ranges6 []geoRange6
+}
+
+// loadGeoIndex reads the GeoLite csvs in dir into a geolocation index
+// rows whose addresses don't parse, like the copyright and header lines, are skipped
+func loadGeoIndex(dir string) (*geoIndex, error) {
+	var locations = make(map[string]latLong)
+	var err = readGeoCSV(filepath.Join(dir, geoLocationsFile), 7, func(fields []string) error {
+		loc, ok := parseLatLong(fields[5], fields[6])
+		if ok {
+			locations[fields[0]] = loc
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var index = &geoIndex{}
+	err = readGeoCSV(filepath.Join(dir, geoBlocksFile), 3, func(fields []string) error {
+		start, err1 := strconv.ParseUint(fields[0], 10, 32)
+		end, err2 := strconv.ParseUint(fields[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+		loc, in := locations[fields[2]]
+		if !in {
+			return errors.New("Block " + fields[0] + " has unknown location " + fields[2])
+		}
+		index.ranges4 = append(index.ranges4, geoRange4{uint32(start), uint32(end), loc})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readGeoCSV(filepath.Join(dir, geoBlocks6File), 10, func(fields []string) error {
+		start, end := net.ParseIP(fields[0]).To16(), net.ParseIP(fields[1]).To16()
+		loc, ok := parseLatLong(fields[8], fields[9])
+		if start == nil || end == nil || !ok {
+			return nil
+		}
+		var block = geoRange6{loc: loc}
+		copy(block.start[:], start)
+		copy(block.end[:], end)
+		index.ranges6 = append(index.ranges6, block)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the GeoLite files are already in order, sort anyway in case they ever aren't
+	sort.Slice(index.ranges4, func(i, j int) bool { return index.ranges4[i].start < index.ranges4[j].start })
+	sort.Slice(index.ranges6, func(i, j int) bool {
+		return bytes.Compare(index.ranges6[i].start[:], index.ranges6[j].start[:]) < 0
+	})
+	return index, nil
+}
+
+// readGeoCSV calls handle with every row of the csv at path that has at least minFields fields
+func readGeoCSV(path string, minFields int, handle func([]string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader = csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("Could not parse " + path + ": " + err.Error())
+		}
+		if len(fields) < minFields {
+			continue
+		}
+		if err = handle(fields); err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+	}
+}
+
+// parseLatLong parses a latitude and longitude pair of csv fields
+func parseLatLong(latField, longField string) (latLong, bool) {
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latField), 64)
+	long, err2 := strconv.ParseFloat(strings.TrimSpace(longField), 64)
+	return latLong{lat, long}, err1 == nil && err2 == nil
+}
+
+// lookup returns where the given ip is, ok is false if no range holds it
+func (index *geoIndex) lookup(ip net.IP) (loc latLong, ok bool) {
+	if index == nil {
+		return latLong{}, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		var num = binary.BigEndian.Uint32(ip4)
+		var i = sort.Search(len(index.ranges4), func(i int) bool { return index.ranges4[i].end >= num })
+		if i < len(index.ranges4) && index.ranges4[i].start <= num {
+			return index.ranges4[i].loc, true
+		}
+		return latLong{}, false
+	}
+	var ip6 = ip.To16()
+	if ip6 == nil {
+		return latLong{}, false
+	}
+	var i = sort.Search(len(index.ranges6), func(i int) bool { return bytes.Compare(index.ranges6[i].end[:], ip6) >= 0 })
+	if i < len(index.ranges6) && bytes.Compare(index.ranges6[i].start[:], ip6) <= 0 {
+		return index.ranges6[i].loc, true
+	}
+	return latLong{}, false
+}
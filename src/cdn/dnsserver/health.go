@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cdn/protocol"
+)
+
+// how often and how patiently each host is checked
+const (
+	healthInterval = 5 * time.Second
+	healthTimeout  = 2 * time.Second
+)
+
+// consecutive results needed to flip a host, so a single slow check doesn't pull it out of answers
+const (
+	healthFall int = 3 // failed checks before an up host is marked down
+	healthRise int = 2 // passed checks before a down host is marked up again
+)
+
+// checkHealth polls the host's health path until the host is removed, marking it up or down as the results come in
+func checkHealth(host *host) {
+	var ip = host.key()
+	var client = &http.Client{Timeout: healthTimeout}
+	var url = "http://" + net.JoinHostPort(ip, strconv.Itoa(host.httpPort)) + protocol.HealthPath
+	// the first check decides where the host starts out, it may not even be running yet
+	host.up.Store(healthCheck(client, url))
+	if !host.up.Load() {
+		fmt.Println("Host", ip, "failed its first health check, leaving it out of answers")
+	}
+	var ticker = time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	var streak = 0 // checks in a row that disagree with the host's current state
+	for {
+		select {
+		case <-host.stop:
+			return
+		case <-ticker.C:
+		}
+		if healthCheck(client, url) == host.up.Load() {
+			streak = 0
+			continue
+		}
+		streak++
+		if host.up.Load() && streak >= healthFall {
+			fmt.Println("Host", ip, "failed", streak, "health checks, removing it from answers")
+			host.up.Store(false)
+			streak = 0
+		} else if !host.up.Load() && streak >= healthRise {
+			fmt.Println("Host", ip, "passed", streak, "health checks, adding it back to answers")
+			host.up.Store(true)
+			streak = 0
+		}
+	}
+}
+
+// healthCheck returns whether a get of url answers 200 in time
+func healthCheck(client *http.Client, url string) bool {
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode == http.StatusOK
+}
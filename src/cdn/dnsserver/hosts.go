@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hosts file read when none is given, see hosts.example.json
+const defaultHostsFile string = "hosts.json"
+
+// a host entry in the json hosts file
+type hostConfig struct {
+	ID          string   `json:"id"`
+	Addresses   []string `json:"addresses"`    // at most one ipv4 and one ipv6 address
+	HTTPPort    int      `json:"http_port"`    // defaults to the dns server's port
+	ControlPort int      `json:"control_port"` // defaults to the http port, which replicas accept control channels on too
+	Capacity    int      `json:"capacity"`     // relative to the other hosts, defaults to 1
+	Region      string   `json:"region"`
+	Location    *struct {
+		Lat  float64 `json:"lat"`
+		Long float64 `json:"long"`
+	} `json:"location"` // used instead of geolocating the host's address
+	Tags  []string `json:"tags"`
+	Drain bool     `json:"drain"` // hands the host out to no new clients while the ones it has finish
+}
+
+// loadHosts reads and validates the hosts file at path, returning new hosts keyed by their primary address
+// the list may be empty when replicas register themselves
+// errors name the line of the host entry they are about, ports left out default to port
+// the hosts have no control channels or health checks yet, see router.applyHosts
+func loadHosts(path string, port int, geo geolocator) (map[string]*host, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var decoder = json.NewDecoder(bytes.NewReader(data))
+	// the file is walked token by token so every entry's position is known for its errors
+	var fail = func(offset int64, message string) error {
+		return errors.New(path + ":" + strconv.Itoa(lineAt(data, offset)) + ": " + message)
+	}
+	var decodeFail = func(err error) error {
+		var offset = decoder.InputOffset()
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			offset = syntaxErr.Offset
+		} else if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			offset = typeErr.Offset
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fail(int64(len(data)), "Unexpected end of file")
+		}
+		return fail(offset, err.Error())
+	}
+	if token, err := decoder.Token(); err != nil {
+		return nil, decodeFail(err)
+	} else if token != json.Delim('{') {
+		return nil, fail(0, "Hosts file must be a json object with a hosts list")
+	}
+	var hosts = make(map[string]*host)
+	var ids = make(map[string]int) // host ids to the lines they were first defined on
+	var sawHosts = false
+	for decoder.More() {
+		var keyOffset = decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, decodeFail(err)
+		}
+		if token != "hosts" {
+			return nil, fail(keyOffset, fmt.Sprintf("Unknown field %v, the hosts file only holds hosts", token))
+		}
+		sawHosts = true
+		if token, err = decoder.Token(); err != nil {
+			return nil, decodeFail(err)
+		} else if token != json.Delim('[') {
+			return nil, fail(decoder.InputOffset(), "Hosts must be a list")
+		}
+		for decoder.More() {
+			var offset = skipBlank(data, decoder.InputOffset())
+			var raw json.RawMessage
+			if err = decoder.Decode(&raw); err != nil {
+				return nil, decodeFail(err)
+			}
+			// misspelled fields would otherwise silently fall back to their defaults
+			var entryDecoder = json.NewDecoder(bytes.NewReader(raw))
+			entryDecoder.DisallowUnknownFields()
+			var config hostConfig
+			if err = entryDecoder.Decode(&config); err != nil {
+				if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+					return nil, fail(offset+typeErr.Offset, "Host "+config.ID+": "+err.Error())
+				}
+				return nil, fail(offset, "Host entry: "+err.Error())
+			}
+			var line = lineAt(data, offset)
+			if first, exists := ids[config.ID]; exists && config.ID != "" {
+				return nil, fail(offset, "Host "+config.ID+" is already defined on line "+strconv.Itoa(first))
+			}
+			ids[config.ID] = line
+			newHost, err := config.toHost(port, geo)
+			if err != nil {
+				return nil, fail(offset, err.Error())
+			}
+			if other, exists := hosts[newHost.key()]; exists {
+				return nil, fail(offset, "Host "+config.ID+" has the same address as host "+other.id)
+			}
+			hosts[newHost.key()] = newHost
+		}
+		if _, err = decoder.Token(); err != nil {
+			return nil, decodeFail(err)
+		}
+	}
+	if !sawHosts {
+		return nil, fail(0, "Hosts file does not have a hosts list")
+	}
+	return hosts, nil
+}
+
+// toHost validates the entry and builds its host, geolocating it unless it has a location
+func (config hostConfig) toHost(port int, geo geolocator) (*host, error) {
+	if config.ID == "" {
+		return nil, errors.New("Host entry needs an id")
+	}
+	var h = &host{id: config.ID, region: config.Region, tags: config.Tags, weight: 1}
+	h.draining.Store(config.Drain)
+	if len(config.Addresses) == 0 {
+		return nil, errors.New("Host " + config.ID + " needs at least one address")
+	}
+	for _, address := range config.Addresses {
+		var ip = net.ParseIP(strings.TrimSpace(address))
+		if ip == nil {
+			return nil, errors.New("Host " + config.ID + " has invalid address " + address)
+		} else if ip4 := ip.To4(); ip4 != nil && h.ip4 == nil {
+			h.ip4 = ip4
+		} else if ip4 == nil && h.ip6 == nil {
+			h.ip6 = ip
+		} else {
+			return nil, errors.New("Host " + config.ID + " can have only one ipv4 and one ipv6 address")
+		}
+	}
+	h.httpPort, h.controlPort = port, config.ControlPort
+	if config.HTTPPort != 0 {
+		h.httpPort = config.HTTPPort
+	}
+	if h.controlPort == 0 {
+		h.controlPort = h.httpPort
+	}
+	if h.httpPort < 1 || h.httpPort > 65535 || h.controlPort < 1 || h.controlPort > 65535 {
+		return nil, errors.New("Host " + config.ID + " has a port outside 1 to 65535")
+	}
+	if config.Capacity < 0 {
+		return nil, errors.New("Host " + config.ID + " has a negative capacity")
+	} else if config.Capacity > 0 {
+		h.weight = config.Capacity
+	}
+	if config.Location != nil {
+		if math.Abs(config.Location.Lat) > 90 || math.Abs(config.Location.Long) > 180 {
+			return nil, errors.New("Host " + config.ID + " has a location outside the globe")
+		}
+		h.loc = latLong{config.Location.Lat, config.Location.Long}
+	} else if loc, ok := geo.lookup(net.ParseIP(h.key())); ok {
+		h.loc = loc
+	} else {
+		fmt.Println("No suitable lat long found for host", config.ID+",", "give it a location in the hosts file")
+	}
+	return h, nil
+}
+
+// lineAt returns the line of the first non blank character at or after offset in data
+func lineAt(data []byte, offset int64) int {
+	return bytes.Count(data[:skipBlank(data, offset)], []byte("\n")) + 1
+}
+
+// skipBlank returns the offset of the first character at or after offset in data that isn't
+// whitespace or a separator, the decoder's offsets point just past the previous value
+func skipBlank(data []byte, offset int64) int64 {
+	offset = min(max(offset, 0), int64(len(data)))
+	for offset < int64(len(data)) && strings.ContainsRune(" \t\r\n,:", rune(data[offset])) {
+		offset++
+	}
+	return offset
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a located host, so loading it doesn't need the geolocation data
+const testHostEntry = `{"id": "us-east", "addresses": ["192.0.2.10", "2001:db8::10"], "location": {"lat": 39, "long": -77}}`
+
+// writeHosts writes a hosts file with the given lines and returns its path
+func writeHosts(t *testing.T, lines ...string) string {
+	var path = filepath.Join(t.TempDir(), "hosts.json")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// valid entries come back keyed by their primary address with their defaults filled in
+func TestLoadHosts(t *testing.T) {
+	var path = writeHosts(t,
+		`{"hosts": [`,
+		`  `+testHostEntry+`,`,
+		`  {"id": "ap-south", "addresses": ["2001:DB8::12"], "http_port": 8080, "capacity": 3, "drain": true, "location": {"lat": 19, "long": 73}}`,
+		`]}`)
+	var hosts, err = loadHosts(path, 53000, &geoIndex{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var east, south = hosts["192.0.2.10"], hosts["2001:db8::12"]
+	if len(hosts) != 2 || east == nil || south == nil {
+		t.Fatalf("loaded %v", hosts)
+	}
+	if east.httpPort != 53000 || east.controlPort != 53000 || east.weight != 1 || east.ip6.String() != "2001:db8::10" {
+		t.Errorf("us-east: http port %d, control port %d, weight %d, ipv6 %s", east.httpPort, east.controlPort, east.weight, east.ip6)
+	}
+	if south.httpPort != 8080 || south.controlPort != 8080 || south.weight != 3 || !south.draining.Load() || south.ip4 != nil {
+		t.Errorf("ap-south: http port %d, control port %d, weight %d, draining %v", south.httpPort, south.controlPort, south.weight, south.draining.Load())
+	}
+}
+
+// every error names the file and the line of the entry or token it is about
+func TestLoadHostsErrors(t *testing.T) {
+	var tests = []struct {
+		name    string
+		lines   []string
+		line    int
+		message string
+	}{
+		{"not an object", []string{`["hosts"]`}, 1, "must be a json object"},
+		{"no hosts list", []string{`{`, `}`}, 1, "does not have a hosts list"},
+		{"unknown top level field", []string{`{`, `  "servers": []`, `}`}, 2, "Unknown field servers"},
+		{"hosts not a list", []string{`{`, `  "hosts":`, `    {}`, `}`}, 3, "must be a list"},
+		{"syntax error", []string{`{"hosts": [`, `  ` + testHostEntry + `,`, `  {"id": "x",,}`, `]}`}, 3, "invalid character"},
+		{"end of file", []string{`{"hosts": [`, `  ` + testHostEntry}, 2, "end of"},
+		{"misspelled field", []string{`{"hosts": [`, `  ` + testHostEntry + `,`, ``, `  {"id": "b", "adresses": ["192.0.2.11"]}`, `]}`}, 4, "unknown field"},
+		{"wrong type", []string{`{"hosts": [`, `  {"id": "b",`, `   "addresses": ["192.0.2.11"],`, `   "http_port": "80"}`, `]}`}, 4, "Host b"},
+		{"no id", []string{`{"hosts": [`, `  ` + testHostEntry + `,`, `  {"addresses": ["192.0.2.11"]}`, `]}`}, 3, "needs an id"},
+		{"no address", []string{`{"hosts": [`, `  {"id": "b"}`, `]}`}, 2, "needs at least one address"},
+		{"bad address", []string{`{"hosts": [`, `  {"id": "b", "addresses": ["192.0.2.256"]}`, `]}`}, 2, "invalid address"},
+		{"two ipv4 addresses", []string{`{"hosts": [`, `  {"id": "b", "addresses": ["192.0.2.11", "192.0.2.12"]}`, `]}`}, 2, "only one ipv4"},
+		{"bad port", []string{`{"hosts": [`, `  {"id": "b", "addresses": ["192.0.2.11"], "control_port": 70000}`, `]}`}, 2, "port outside"},
+		{"negative capacity", []string{`{"hosts": [`, `  {"id": "b", "addresses": ["192.0.2.11"], "capacity": -1}`, `]}`}, 2, "negative capacity"},
+		{"off the globe", []string{`{"hosts": [`, `  {"id": "b", "addresses": ["192.0.2.11"], "location": {"lat": 91, "long": 0}}`, `]}`}, 2, "outside the globe"},
+		{"duplicate id", []string{`{"hosts": [`, `  ` + testHostEntry + `,`, `  {"id": "us-east", "addresses": ["192.0.2.11"]}`, `]}`}, 3, "already defined on line 2"},
+		{"duplicate address", []string{`{"hosts": [`, `  ` + testHostEntry + `,`, `  {"id": "b", "addresses": ["192.0.2.10"], "location": {"lat": 0, "long": 0}}`, `]}`}, 3, "same address as host us-east"},
+	}
+	for _, test := range tests {
+		var path = writeHosts(t, test.lines...)
+		var _, err = loadHosts(path, 80, &geoIndex{})
+		if err == nil {
+			t.Errorf("%s: loaded, want an error", test.name)
+			continue
+		}
+		var prefix = path + ":" + strconv.Itoa(test.line) + ": "
+		if !strings.HasPrefix(err.Error(), prefix) || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: %q, want it to start with %q and mention %q", test.name, err, prefix, test.message)
+		}
+	}
+}
+
+// lines are counted from the first character that isn't blank or a separator
+func TestLineAt(t *testing.T) {
+	var data = []byte("{\n  \"a\": 1,\n\n  \"b\": 2\n}")
+	var tests = []struct {
+		offset int64
+		line   int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 2},
+		{11, 4},
+		{12, 4},
+		{int64(len(data)) - 1, 5},
+		{int64(len(data)) + 10, 5},
+	}
+	for _, test := range tests {
+		if line := lineAt(data, test.offset); line != test.line {
+			t.Errorf("lineAt(%d) = %d, want %d", test.offset, line, test.line)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"net"
+)
+
+// listenOneUDP opens a single dual stack udp socket on port, used where the port can't be shared
+func listenOneUDP(port int) ([]*net.UDPConn, error) {
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{connection}, nil
+}
@@ -0,0 +1,45 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_REUSEPORT in the generic linux socket options every architecture but mips uses,
+// the syscall package only exports it on some of them
+const soReusePort = 0xf
+
+// listenUDP opens count dual stack udp sockets on port so each reader thread gets its own socket,
+// they share the port through SO_REUSEPORT and the kernel spreads packets across them
+func listenUDP(port int, count int) ([]*net.UDPConn, error) {
+	if count < 2 {
+		return listenOneUDP(port)
+	}
+	var config = net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	var address = ":" + strconv.Itoa(port)
+	var connections = make([]*net.UDPConn, 0, count)
+	for i := 0; i < count; i++ {
+		packetConn, err := config.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			for _, connection := range connections {
+				connection.Close()
+			}
+			return nil, err
+		}
+		connections = append(connections, packetConn.(*net.UDPConn))
+	}
+	return connections, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"net"
+)
+
+// listenUDP opens a single socket whatever the count, the port is only shared between sockets on linux
+func listenUDP(port int, count int) ([]*net.UDPConn, error) {
+	return listenOneUDP(port)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"cdn/protocol"
+)
+
+// load reports older than this are ignored, the replica has stopped reporting or lost its channel
+const loadStaleAfter = 3 * protocol.LoadReportInterval
+
+// a host carrying more than this many times its fair share of the load, as set by the capacity
+// weights of the hosts, is handed out after the hosts that still have spare capacity
+const overloadFactor float64 = 1.5
+
+// below these totals across the hosts the load is too light to be worth spreading
+const (
+	minLoadConnections float64 = 8
+	minLoadRPS         float64 = 4
+)
+
+// a host's last load report and when it arrived
+type hostLoad struct {
+	report   protocol.LoadReport
+	received time.Time
+}
+
+// ranks hosts that report their load by utilization relative to their capacity, least utilized
+// first, leaving out hosts without a recent report
+type loadPolicy struct{}
+
+// handleLoadReport records the load the host reported
+func (h *host) handleLoadReport(report protocol.LoadReport) {
+	h.load.Store(&hostLoad{report, time.Now()})
+}
+
+// currentLoad returns the host's last load report if it is recent enough to go by
+func (h *host) currentLoad() (protocol.LoadReport, bool) {
+	var load = h.load.Load()
+	if load == nil || time.Since(load.received) > loadStaleAfter {
+		return protocol.LoadReport{}, false
+	}
+	return load.report, true
+}
+
+// utilization returns each reporting candidate's share of the candidates' load divided by its share of
+// their capacity, 1 is a fair share, by whichever of connections and requests per second it carries more of
+// nothing is returned while the candidates' total load is too light to tell hosts apart
+func (r *router) utilization(candidates []string) map[string]float64 {
+	var reports = make(map[string]protocol.LoadReport, len(candidates))
+	var totalConnections, totalRPS, totalWeight = 0.0, 0.0, 0.0
+	for _, server := range candidates {
+		if report, ok := r.hosts[server].currentLoad(); ok {
+			reports[server] = report
+			totalConnections += float64(report.Connections)
+			totalRPS += report.RPS
+			totalWeight += float64(r.hosts[server].capacity())
+		}
+	}
+	var result = make(map[string]float64, len(reports))
+	if totalConnections < minLoadConnections && totalRPS < minLoadRPS {
+		return result
+	}
+	for server, report := range reports {
+		var share = 0.0
+		if totalConnections > 0 {
+			share = float64(report.Connections) / totalConnections
+		}
+		if totalRPS > 0 {
+			share = max(share, report.RPS/totalRPS)
+		}
+		result[server] = share / (float64(r.hosts[server].capacity()) / totalWeight)
+	}
+	return result
+}
+
+// preferSpare moves hosts carrying well over their share of the load behind the others,
+// keeping the policy's order within each group
+func (r *router) preferSpare(ranked []string) []string {
+	var utilization = r.utilization(ranked)
+	var spare = make([]string, 0, len(ranked))
+	var overloaded = make([]string, 0)
+	for _, server := range ranked {
+		if utilization[server] > overloadFactor {
+			overloaded = append(overloaded, server)
+		} else {
+			spare = append(spare, server)
+		}
+	}
+	return append(spare, overloaded...)
+}
+
+func (loadPolicy) rank(r *router, client string, candidates []string) []string {
+	var utilization = r.utilization(candidates)
+	var result = make([]string, 0, len(utilization))
+	for _, server := range candidates {
+		if _, in := utilization[server]; in {
+			result = append(result, server)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return utilization[result[i]] < utilization[result[j]] })
+	return result
+}
+
+// capacity returns the host's capacity weight, at least 1
+func (h *host) capacity() int {
+	return max(h.weight, 1)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaults for the measurement store, clients are grouped by the networks they are routed alike in
+const (
+	defaultPrefix4       int = 24
+	defaultPrefix6       int = 48
+	defaultRTTHalfLife       = 10 * time.Minute
+	defaultMaxPrefixes   int = 100000
+	prefixStaleHalfLives     = 10 // half lives after which a prefix no host has measured is forgotten
+)
+
+// a client prefix is asked to be measured at most once per probeInterval,
+// and not at all while some host has measured it within the interval
+const probeInterval = time.Minute
+
+// networks that are never probed, the private and special purpose ones that aren't covered by net.IP's methods
+var reservedNetworks = parseNetworks(
+	"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15", "198.51.100.0/24",
+	"203.0.113.0/24", "240.0.0.0/4", "64:ff9b::/96", "100::/64", "2001::/23", "2001:db8::/32")
+
+// a host's time decayed average rtt to a client prefix
+// every measurement's weight halves each half life, so old rtts fade out as new ones come in
+type rttEstimate struct {
+	avg     float64   // weighted average rtt in milliseconds
+	weight  float64   // decayed number of measurements behind avg, as of updated
+	samples int       // measurements ever added
+	updated time.Time // when the last measurement was added
+}
+
+// the rtts of every host to one client prefix, kept in a list from most to least recently measured
+type prefixEntry struct {
+	key     string
+	hosts   map[string]*rttEstimate // host ips to their rtts to the prefix
+	updated time.Time               // when any host last measured the prefix
+}
+
+// rtts from hosts to clients aggregated by client prefix, using at most maxPrefixes entries
+// prefixes that haven't been measured in a long time, or for longest once the store is full, are evicted
+type measurementStore struct {
+	prefix4     int // prefix length ipv4 clients are grouped by
+	prefix6     int // prefix length ipv6 clients are grouped by
+	halfLife    time.Duration
+	maxPrefixes int
+	prefixes    map[string]*list.Element // client prefixes to their elements in recent
+	recent      *list.List               // prefix entries, most recently measured first
+	probed      map[string]time.Time     // client prefixes to when hosts were last asked to measure them
+	mutex       sync.Mutex               // lock for prefixes, recent and probed
+}
+
+// newMeasurementStore creates a store grouping clients into /prefix4 and /prefix6 networks
+func newMeasurementStore(prefix4, prefix6 int, halfLife time.Duration, maxPrefixes int) (*measurementStore, error) {
+	if prefix4 < 1 || prefix4 > 32 || prefix6 < 1 || prefix6 > 128 {
+		return nil, errors.New("Client prefix lengths must be between 1 and 32 for ipv4 and 1 and 128 for ipv6")
+	} else if halfLife <= 0 {
+		return nil, errors.New("Rtt half life must be positive")
+	} else if maxPrefixes < 1 {
+		return nil, errors.New("Measurement store must hold at least one prefix")
+	}
+	return &measurementStore{
+		prefix4:     prefix4,
+		prefix6:     prefix6,
+		halfLife:    halfLife,
+		maxPrefixes: maxPrefixes,
+		prefixes:    make(map[string]*list.Element),
+		recent:      list.New(),
+		probed:      make(map[string]time.Time)}, nil
+}
+
+// prefixOf returns the client prefix ip is grouped into
+func (store *measurementStore) prefixOf(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		var mask = net.CIDRMask(store.prefix4, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	var mask = net.CIDRMask(store.prefix6, 128)
+	return &net.IPNet{IP: ip.To16().Mask(mask), Mask: mask}
+}
+
+// add records an rtt in milliseconds from the host to the client ip
+func (store *measurementStore) add(client net.IP, server string, rtt float64) {
+	store.addPrefix(store.prefixOf(client), server, rtt)
+}
+
+// addReport records an rtt from the host to a whole network, as sent in passive rtt reports
+// networks smaller than the store's prefixes are measured as their enclosing prefix,
+// larger ones are dropped since they would spread one rtt over prefixes it may not describe
+func (store *measurementStore) addReport(cidr string, server string, rtt float64) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	var ones, _ = network.Mask.Size()
+	var prefix = store.prefixOf(network.IP)
+	if prefixOnes, _ := prefix.Mask.Size(); ones < prefixOnes {
+		return errors.New("Reported network " + cidr + " is larger than the store's client prefixes")
+	}
+	store.addPrefix(prefix, server, rtt)
+	return nil
+}
+
+// addPrefix folds rtt into the host's estimate for the prefix and marks the prefix most recently measured
+func (store *measurementStore) addPrefix(prefix *net.IPNet, server string, rtt float64) {
+	var now = time.Now()
+	var key = prefix.String()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var entry *prefixEntry
+	if element, in := store.prefixes[key]; in {
+		store.recent.MoveToFront(element)
+		entry = element.Value.(*prefixEntry)
+	} else {
+		entry = &prefixEntry{key: key, hosts: make(map[string]*rttEstimate)}
+		store.prefixes[key] = store.recent.PushFront(entry)
+	}
+	var estimate, in = entry.hosts[server]
+	if !in {
+		estimate = &rttEstimate{}
+		entry.hosts[server] = estimate
+	}
+	estimate.weight = store.decayed(estimate, now) + 1
+	estimate.avg += (rtt - estimate.avg) / estimate.weight
+	estimate.samples++
+	estimate.updated = now
+	entry.updated = now
+	store.evict(now)
+}
+
+// evict drops the least recently measured prefixes while the store is over its cap or they have gone stale,
+// the caller must hold the mutex
+func (store *measurementStore) evict(now time.Time) {
+	var staleAfter = prefixStaleHalfLives * store.halfLife
+	for store.recent.Len() > 0 {
+		var oldest = store.recent.Back()
+		var entry = oldest.Value.(*prefixEntry)
+		if store.recent.Len() <= store.maxPrefixes && now.Sub(entry.updated) < staleAfter {
+			return
+		}
+		store.recent.Remove(oldest)
+		delete(store.prefixes, entry.key)
+	}
+}
+
+// decayed returns the estimate's weight decayed to now, the caller must hold the mutex
+func (store *measurementStore) decayed(estimate *rttEstimate, now time.Time) float64 {
+	if estimate.weight == 0 {
+		return 0
+	}
+	return estimate.weight * math.Exp2(-now.Sub(estimate.updated).Seconds()/store.halfLife.Seconds())
+}
+
+// estimate returns the host's rtt to the client's prefix with its weight decayed to now
+func (store *measurementStore) estimate(client net.IP, server string) (rttEstimate, bool) {
+	if client == nil {
+		return rttEstimate{}, false
+	}
+	var key = store.prefixOf(client).String()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var element, in = store.prefixes[key]
+	if !in {
+		return rttEstimate{}, false
+	}
+	estimate, in := element.Value.(*prefixEntry).hosts[server]
+	if !in {
+		return rttEstimate{}, false
+	}
+	var result = *estimate
+	result.weight = store.decayed(estimate, time.Now())
+	return result, true
+}
+
+// shouldProbe returns whether hosts should be asked to measure the client, and if so notes that they were
+// clients whose prefix was measured or probed within the probe interval aren't probed again,
+// and neither are addresses hosts can't reach, such as private and reserved ones
+func (store *measurementStore) shouldProbe(client net.IP) bool {
+	if !publicAddress(client) {
+		return false
+	}
+	var now = time.Now()
+	var key = store.prefixOf(client).String()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if element, in := store.prefixes[key]; in && now.Sub(element.Value.(*prefixEntry).updated) < probeInterval {
+		return false
+	} else if now.Sub(store.probed[key]) < probeInterval {
+		return false
+	}
+	if len(store.probed) >= store.maxPrefixes {
+		for prefix, probed := range store.probed {
+			if now.Sub(probed) >= probeInterval {
+				delete(store.probed, prefix)
+			}
+		}
+		if len(store.probed) >= store.maxPrefixes {
+			return false
+		}
+	}
+	store.probed[key] = now
+	return true
+}
+
+// publicAddress returns whether ip is a global unicast address outside the private and reserved networks
+func publicAddress(ip net.IP) bool {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNetworks parses the cidrs, which must be valid
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks = make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
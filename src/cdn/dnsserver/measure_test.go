@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// testStore creates a store with the default prefixes, a one minute half life and room for maxPrefixes
+func testStore(t *testing.T, maxPrefixes int) *measurementStore {
+	var store, err = newMeasurementStore(defaultPrefix4, defaultPrefix6, time.Minute, maxPrefixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// age moves every measurement of the client's prefix back by d, as if they had been taken d earlier
+func age(store *measurementStore, client string, d time.Duration) {
+	var entry = store.prefixes[store.prefixOf(net.ParseIP(client)).String()].Value.(*prefixEntry)
+	entry.updated = entry.updated.Add(-d)
+	for _, estimate := range entry.hosts {
+		estimate.updated = estimate.updated.Add(-d)
+	}
+}
+
+// a measurement's weight halves every half life, so newer rtts count for more in the average
+func TestRTTDecay(t *testing.T) {
+	var tests = []struct {
+		name    string
+		rtts    []float64
+		gap     time.Duration // time between the measurements
+		since   time.Duration // time since the last one
+		avg     float64
+		weight  float64
+		samples int
+	}{
+		{"one", []float64{40}, 0, 0, 40, 1, 1},
+		{"two at once", []float64{40, 20}, 0, 0, 30, 2, 2},
+		{"one half life old", []float64{40}, 0, time.Minute, 40, 0.5, 1},
+		{"two half lives old", []float64{40}, 0, 2 * time.Minute, 40, 0.25, 1},
+		{"newer counts double", []float64{10, 40}, time.Minute, 0, 30, 1.5, 2},
+		{"long gone", []float64{100, 20}, 10 * time.Minute, 0, 100 - 80/(1+math.Exp2(-10)), 1 + math.Exp2(-10), 2},
+	}
+	for _, test := range tests {
+		var store = testStore(t, 10)
+		for i, rtt := range test.rtts {
+			if i > 0 {
+				age(store, "8.8.8.8", test.gap)
+			}
+			store.add(net.ParseIP("8.8.8.8"), "192.0.2.10", rtt)
+		}
+		age(store, "8.8.8.8", test.since)
+		var estimate, found = store.estimate(net.ParseIP("8.8.8.9"), "192.0.2.10")
+		if !found {
+			t.Errorf("%s: no estimate for another client in the prefix", test.name)
+			continue
+		}
+		if math.Abs(estimate.avg-test.avg) > 1e-6 || math.Abs(estimate.weight-test.weight) > 1e-3 || estimate.samples != test.samples {
+			t.Errorf("%s: avg %v, weight %v, %d samples, want %v, %v, %d", test.name,
+				estimate.avg, estimate.weight, estimate.samples, test.avg, test.weight, test.samples)
+		}
+	}
+}
+
+// once full, the store evicts the least recently measured prefix, and prefixes gone stale are dropped
+func TestRTTEviction(t *testing.T) {
+	var tests = []struct {
+		name    string
+		clients []string // measured in order
+		stale   string   // aged past staleness before the last measurement, empty for none
+		kept    []string
+		evicted []string
+	}{
+		{"under the cap", []string{"1.1.1.1", "2.2.2.2"}, "", []string{"1.1.1.1", "2.2.2.2"}, nil},
+		{"same prefix", []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.4"}, "", []string{"1.1.1.9"}, nil},
+		{"oldest goes", []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}, "", []string{"2.2.2.2", "3.3.3.3", "4.4.4.4"}, []string{"1.1.1.1"}},
+		{"remeasured stays", []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "1.1.1.1", "4.4.4.4"}, "",
+			[]string{"1.1.1.1", "3.3.3.3", "4.4.4.4"}, []string{"2.2.2.2"}},
+		{"ipv6 prefixes", []string{"2600:1::1", "2600:1::2", "2600:1:0:1::1", "2600:2::1"}, "", []string{"2600:1::3", "2600:2::9"}, nil},
+		{"stale", []string{"1.1.1.1", "2.2.2.2"}, "1.1.1.1", []string{"2.2.2.2"}, []string{"1.1.1.1"}},
+	}
+	for _, test := range tests {
+		var store = testStore(t, 3)
+		for i, client := range test.clients {
+			if test.stale != "" && i == len(test.clients)-1 {
+				age(store, test.stale, prefixStaleHalfLives*store.halfLife)
+			}
+			store.add(net.ParseIP(client), "192.0.2.10", 10)
+		}
+		for _, client := range test.kept {
+			if _, found := store.estimate(net.ParseIP(client), "192.0.2.10"); !found {
+				t.Errorf("%s: %s was evicted", test.name, client)
+			}
+		}
+		for _, client := range test.evicted {
+			if _, found := store.estimate(net.ParseIP(client), "192.0.2.10"); found {
+				t.Errorf("%s: %s was kept", test.name, client)
+			}
+		}
+		if store.recent.Len() != len(store.prefixes) || store.recent.Len() > store.maxPrefixes {
+			t.Errorf("%s: %d prefixes listed and %d indexed, cap %d", test.name, store.recent.Len(), len(store.prefixes), store.maxPrefixes)
+		}
+	}
+}
+
+// a prefix is probed at most once per probe interval, not while hosts have measured it lately,
+// never when it can't be reached, and not at all once the store has too many probes outstanding
+func TestShouldProbe(t *testing.T) {
+	var store = testStore(t, 3)
+	var tests = []struct {
+		name   string
+		client string
+		setup  func()
+		probe  bool
+	}{
+		{"new prefix", "8.8.8.8", nil, true},
+		{"same prefix right after", "8.8.8.9", nil, false},
+		{"after the interval", "8.8.8.8", func() { store.probed["8.8.8.0/24"] = time.Now().Add(-probeInterval) }, true},
+		{"measured lately", "1.1.1.1", func() { store.add(net.ParseIP("1.1.1.1"), "192.0.2.10", 10) }, false},
+		{"measured long ago", "1.1.1.1", func() { age(store, "1.1.1.1", probeInterval) }, true},
+		{"private", "10.1.2.3", nil, false},
+		{"loopback", "127.0.0.1", nil, false},
+		{"shared address space", "100.64.1.1", nil, false},
+		{"documentation", "2001:db8::1", nil, false},
+		{"ipv6", "2600:1f18::1", nil, true},
+		{"too many outstanding", "9.9.9.9", nil, false},
+		{"room after probes expire", "9.9.9.9", func() { store.probed["8.8.8.0/24"] = time.Now().Add(-probeInterval) }, true},
+		{"nil", "", nil, false},
+	}
+	for _, test := range tests {
+		if test.setup != nil {
+			test.setup()
+		}
+		if probe := store.shouldProbe(net.ParseIP(test.client)); probe != test.probe {
+			t.Errorf("%s: shouldProbe(%s) = %v, want %v", test.name, test.client, probe, test.probe)
+		}
+	}
+}
+
+// passive reports land in the prefix they are inside of, and reports for larger networks are rejected
+func TestAddReport(t *testing.T) {
+	var store = testStore(t, 10)
+	var tests = []struct {
+		cidr   string
+		client string // a client whose prefix gets the rtt
+		ok     bool
+	}{
+		{"81.2.69.0/24", "81.2.69.200", true},
+		{"81.2.70.128/25", "81.2.70.1", true},
+		{"81.2.0.0/16", "", false},
+		{"2600:1f18:42::/48", "2600:1f18:42::1", true},
+		{"2600:1f18::/32", "", false},
+		{"not a cidr", "", false},
+	}
+	for _, test := range tests {
+		var err = store.addReport(test.cidr, "192.0.2.10", 25)
+		if (err == nil) != test.ok {
+			t.Errorf("addReport(%s) = %v, want ok %v", test.cidr, err, test.ok)
+		} else if _, found := store.estimate(net.ParseIP(test.client), "192.0.2.10"); test.ok && !found {
+			t.Errorf("addReport(%s): no estimate for %s", test.cidr, test.client)
+		}
+	}
+}
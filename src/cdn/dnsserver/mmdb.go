@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// data types of the MaxMind DB data section, types past 7 are stored in an extended type byte
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+// the metadata section starts after the last occurrence of this marker in the final 128KiB of the file
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const mmdbMetadataMaxSize int = 128 * 1024
+
+// the data section is separated from the search tree by this many zero bytes
+const mmdbDataSeparator int = 16
+
+// how often a watched database file is checked for changes
+const mmdbPollInterval = 10 * time.Second
+
+// a section of a MaxMind DB holding encoded values, pointers are offsets from its start
+type mmdbSection []byte
+
+// a MaxMind DB file read into memory
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbSection
+	nodeCount  uint32
+	recordSize int    // bits per record, two records per node
+	ipVersion  int    // 6 if the tree holds ipv6 addresses with ipv4 under ::/96
+	ipv4Start  uint32 // node ipv4 lookups start from
+}
+
+// a MaxMind DB that is reopened whenever the file on disk changes
+type mmdbWatcher struct {
+	path    string
+	db      *mmdbReader
+	modTime time.Time
+	mutex   sync.RWMutex // lock for db and modTime
+}
+
+// openMMDB reads and validates the MaxMind DB at path
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var searchFrom = len(buf) - mmdbMetadataMaxSize
+	if searchFrom < 0 {
+		searchFrom = 0
+	}
+	var marker = bytes.LastIndex(buf[searchFrom:], mmdbMetadataMarker)
+	if marker == -1 {
+		return nil, errors.New(path + " is not a MaxMind DB file")
+	}
+	marker += searchFrom
+	value, _, err := mmdbSection(buf[marker+len(mmdbMetadataMarker):]).decode(0)
+	if err != nil {
+		return nil, errors.New("Could not parse metadata of " + path + ": " + err.Error())
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Metadata of " + path + " is not a map")
+	}
+	nodeCount, ok1 := metadata["node_count"].(uint64)
+	recordSize, ok2 := metadata["record_size"].(uint64)
+	ipVersion, ok3 := metadata["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, errors.New("Metadata of " + path + " is missing node_count, record_size or ip_version")
+	} else if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errors.New("Unsupported record size " + intToString(int(recordSize)) + " in " + path)
+	} else if ipVersion != 4 && ipVersion != 6 {
+		return nil, errors.New("Unsupported ip version " + intToString(int(ipVersion)) + " in " + path)
+	} else if nodeCount > math.MaxUint32 {
+		return nil, errors.New("Node count of " + path + " does not fit in a record")
+	}
+	var treeSize = int(nodeCount) * int(recordSize) / 4
+	if treeSize+mmdbDataSeparator > marker {
+		return nil, errors.New("Search tree of " + path + " is larger than the file")
+	}
+	var db = &mmdbReader{
+		tree:       buf[:treeSize],
+		data:       mmdbSection(buf[treeSize+mmdbDataSeparator : marker]),
+		nodeCount:  uint32(nodeCount),
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion)}
+	// ipv4 addresses live in the ipv6 tree as ::a.b.c.d
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readNode(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a search tree node
+func (db *mmdbReader) readNode(node uint32, bit uint) uint32 {
+	var off = int(node) * db.recordSize / 4
+	switch db.recordSize {
+	case 24:
+		off += int(bit) * 3
+		return uint32(db.tree[off])<<16 | uint32(db.tree[off+1])<<8 | uint32(db.tree[off+2])
+	case 28:
+		// the middle byte holds the high nibble of both records
+		if bit == 0 {
+			return uint32(db.tree[off+3]&0xF0)<<20 | uint32(db.tree[off])<<16 | uint32(db.tree[off+1])<<8 | uint32(db.tree[off+2])
+		}
+		return uint32(db.tree[off+3]&0x0F)<<24 | uint32(db.tree[off+4])<<16 | uint32(db.tree[off+5])<<8 | uint32(db.tree[off+6])
+	default:
+		return binary.BigEndian.Uint32(db.tree[off+int(bit)*4:])
+	}
+}
+
+// lookup walks the search tree for ip and reads the location out of the record it ends at
+func (db *mmdbReader) lookup(ip net.IP) (latLong, bool) {
+	var node uint32
+	var address []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		node, address = db.ipv4Start, ip4
+	} else if ip6 := ip.To16(); ip6 != nil && db.ipVersion == 6 {
+		address = ip6
+	} else {
+		return latLong{}, false
+	}
+	for i := 0; i < len(address)*8 && node < db.nodeCount; i++ {
+		node = db.readNode(node, uint(address[i/8]>>(7-uint(i%8)))&1)
+	}
+	// a record equal to the node count means there is no data for the address
+	if node <= db.nodeCount {
+		return latLong{}, false
+	}
+	var record = int(node-db.nodeCount) - mmdbDataSeparator
+	lat, err1 := db.data.float(record, "location", "latitude")
+	long, err2 := db.data.float(record, "location", "longitude")
+	if err1 != nil || err2 != nil {
+		return latLong{}, false
+	}
+	return latLong{lat, long}, true
+}
+
+// control reads the control byte of the value at off
+// it returns the value's type, its size or pointer target, and the offset of its payload
+func (section mmdbSection) control(off int) (int, int, int, error) {
+	if off < 0 || off >= len(section) {
+		return 0, 0, 0, errors.New("MaxMind DB value is outside its section")
+	}
+	var ctrl = section[off]
+	var typ = int(ctrl >> 5)
+	off++
+	if typ == mmdbPointer {
+		var length = int(ctrl>>3&0x3) + 1
+		if off+length > len(section) {
+			return 0, 0, 0, errors.New("MaxMind DB pointer runs past the end of its section")
+		}
+		var p = int(ctrl & 0x7)
+		for _, b := range section[off : off+length] {
+			p = p<<8 | int(b)
+		}
+		switch length {
+		case 2:
+			p += 2048
+		case 3:
+			p += 526336
+		case 4:
+			// the pointer is just the four bytes, drop the bits taken from the control byte
+			p = int(binary.BigEndian.Uint32(section[off:]))
+		}
+		return typ, p, off + length, nil
+	}
+	if typ == 0 {
+		if off >= len(section) {
+			return 0, 0, 0, errors.New("MaxMind DB extended type runs past the end of its section")
+		}
+		typ = 7 + int(section[off])
+		off++
+	}
+	var size = int(ctrl & 0x1F)
+	if size >= 29 {
+		var length = size - 28
+		if off+length > len(section) {
+			return 0, 0, 0, errors.New("MaxMind DB size runs past the end of its section")
+		}
+		var extra = 0
+		for _, b := range section[off : off+length] {
+			extra = extra<<8 | int(b)
+		}
+		size = []int{29, 285, 65821}[length-1] + extra
+		off += length
+	}
+	return typ, size, off, nil
+}
+
+// payload returns the size bytes of a value's payload starting at off
+func (section mmdbSection) payload(off, size int) ([]byte, error) {
+	if off+size > len(section) {
+		return nil, errors.New("MaxMind DB value runs past the end of its section")
+	}
+	return section[off : off+size], nil
+}
+
+// decode decodes the value at off into go values, returning it and the offset after it
+// maps become map[string]interface{}, arrays []interface{} and unsigned integers uint64
+func (section mmdbSection) decode(off int) (interface{}, int, error) {
+	typ, size, next, err := section.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		if targetType, _, _, err := section.control(size); err != nil {
+			return nil, 0, err
+		} else if targetType == mmdbPointer {
+			return nil, 0, errors.New("MaxMind DB pointer points at another pointer")
+		}
+		value, _, err := section.decode(size)
+		return value, next, err
+	}
+	switch typ {
+	case mmdbMap:
+		var result = make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, value interface{}
+			if key, next, err = section.decode(next); err != nil {
+				return nil, 0, err
+			}
+			if value, next, err = section.decode(next); err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("MaxMind DB map key is not a string")
+			}
+			result[keyString] = value
+		}
+		return result, next, nil
+	case mmdbArray:
+		var result = make([]interface{}, size)
+		for i := range result {
+			if result[i], next, err = section.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return result, next, nil
+	case mmdbBool:
+		return size != 0, next, nil
+	}
+	raw, err := section.payload(next, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	next += size
+	switch typ {
+	case mmdbString:
+		return string(raw), next, nil
+	case mmdbBytes:
+		return append([]byte(nil), raw...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("MaxMind DB double is not 8 bytes")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("MaxMind DB float is not 4 bytes")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.New("MaxMind DB unsigned integer is too long")
+		}
+		var result uint64
+		for _, b := range raw {
+			result = result<<8 | uint64(b)
+		}
+		return result, next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.New("MaxMind DB signed integer is too long")
+		}
+		var result uint32
+		for _, b := range raw {
+			result = result<<8 | uint32(b)
+		}
+		return int64(int32(result)), next, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(raw), next, nil
+	}
+	return nil, 0, errors.New("Unsupported MaxMind DB data type " + intToString(typ))
+}
+
+// skip returns the offset just past the value at off without decoding it
+func (section mmdbSection) skip(off int) (int, error) {
+	typ, size, next, err := section.control(off)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case mmdbPointer, mmdbBool:
+		return next, nil
+	case mmdbMap, mmdbArray:
+		if typ == mmdbMap {
+			size *= 2
+		}
+		for i := 0; i < size && err == nil; i++ {
+			next, err = section.skip(next)
+		}
+		return next, err
+	}
+	return next + size, nil
+}
+
+// find follows map keys from the value at off and returns the offset of the value at the end of the path
+// only the keys along the path are decoded, so looking up one field of a large record stays cheap
+func (section mmdbSection) find(off int, path ...string) (int, error) {
+	for _, key := range path {
+		typ, size, next, err := section.control(off)
+		if err != nil {
+			return 0, err
+		}
+		if typ == mmdbPointer {
+			if typ, size, next, err = section.control(size); err != nil {
+				return 0, err
+			}
+		}
+		if typ != mmdbMap {
+			return 0, errors.New("MaxMind DB value at " + intToString(off) + " is not a map")
+		}
+		var found = false
+		for i := 0; i < size && !found; i++ {
+			name, valueOff, err := section.decode(next)
+			if err != nil {
+				return 0, err
+			}
+			if found = name == key; found {
+				off = valueOff
+			} else if next, err = section.skip(valueOff); err != nil {
+				return 0, err
+			}
+		}
+		if !found {
+			return 0, errors.New("MaxMind DB record has no " + key)
+		}
+	}
+	return off, nil
+}
+
+// float returns the number at the end of the path of map keys from the value at off
+func (section mmdbSection) float(off int, path ...string) (float64, error) {
+	off, err := section.find(off, path...)
+	if err != nil {
+		return 0.0, err
+	}
+	value, _, err := section.decode(off)
+	if err != nil {
+		return 0.0, err
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return 0.0, errors.New("MaxMind DB value at " + intToString(off) + " is not a floating point number")
+	}
+	return number, nil
+}
+
+// watchMMDB opens the MaxMind DB at path and reloads it in the background whenever its modification time changes
+func watchMMDB(path string) (*mmdbWatcher, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	var watcher = &mmdbWatcher{path: path, db: db, modTime: info.ModTime()}
+	go watcher.poll(mmdbPollInterval)
+	return watcher, nil
+}
+
+// poll checks the database file every interval, swapping in the new database once it opens cleanly
+// a file that fails to open, say because it is still being written, is retried on the next tick
+func (watcher *mmdbWatcher) poll(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(watcher.path)
+		if errorCheck(err) {
+			continue
+		}
+		watcher.mutex.RLock()
+		var changed = !info.ModTime().Equal(watcher.modTime)
+		watcher.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		db, err := openMMDB(watcher.path)
+		if errorCheck(err) {
+			continue
+		}
+		watcher.mutex.Lock()
+		watcher.db, watcher.modTime = db, info.ModTime()
+		watcher.mutex.Unlock()
+	}
+}
+
+// lookup finds ip in whichever database is currently loaded
+func (watcher *mmdbWatcher) lookup(ip net.IP) (latLong, bool) {
+	watcher.mutex.RLock()
+	var db = watcher.db
+	watcher.mutex.RUnlock()
+	return db.lookup(ip)
+}
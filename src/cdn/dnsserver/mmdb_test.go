@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodeValue encodes a value of a type stored in the control byte with the given payload
+func encodeValue(typ int, payload []byte) []byte {
+	return append([]byte{byte(typ<<5 | len(payload))}, payload...)
+}
+
+// encodeString, encodeDouble and encodeUint encode values short enough for their size to fit the control byte
+func encodeString(s string) []byte {
+	return encodeValue(mmdbString, []byte(s))
+}
+
+func encodeDouble(f float64) []byte {
+	return encodeValue(mmdbDouble, binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func encodeUint(v uint32) []byte {
+	return encodeValue(mmdbUint32, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// encodePointer encodes a pointer with one byte after the control byte, enough for targets below 2048
+func encodePointer(target int) []byte {
+	return []byte{byte(mmdbPointer<<5 | target>>8), byte(target)}
+}
+
+// encodeMap encodes a map from alternating encoded keys and values
+func encodeMap(pairs ...[]byte) []byte {
+	var result = []byte{byte(mmdbMap<<5 | len(pairs)/2)}
+	for _, encoded := range pairs {
+		result = append(result, encoded...)
+	}
+	return result
+}
+
+// encodeLocation encodes the map a record keeps under "location"
+func encodeLocation(lat, long float64) []byte {
+	return encodeMap(encodeString("latitude"), encodeDouble(lat), encodeString("longitude"), encodeDouble(long))
+}
+
+// packTree packs left and right records of each node at the given record size
+func packTree(nodes [][2]uint32, recordSize int) []byte {
+	var tree []byte
+	for _, node := range nodes {
+		var left, right = node[0], node[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(left>>24<<4|right>>24&0x0F),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			tree = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(tree, left), right)
+		}
+	}
+	return tree
+}
+
+// writeMMDB writes a database with the given tree and data section and opens it
+func writeMMDB(t *testing.T, nodes [][2]uint32, data []byte, recordSize int, ipVersion uint32) *mmdbReader {
+	var file = packTree(nodes, recordSize)
+	file = append(file, make([]byte, mmdbDataSeparator)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, encodeMap(
+		encodeString("node_count"), encodeUint(uint32(len(nodes))),
+		encodeString("record_size"), encodeUint(uint32(recordSize)),
+		encodeString("ip_version"), encodeUint(ipVersion))...)
+	var path = filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		t.Fatalf("record size %d: %v", recordSize, err)
+	}
+	return db
+}
+
+type mmdbLookupTest struct {
+	ip    string
+	found bool
+	loc   latLong
+}
+
+// checkLookups looks up every address and compares what was found
+func checkLookups(t *testing.T, db *mmdbReader, tests []mmdbLookupTest) {
+	for _, test := range tests {
+		var loc, found = db.lookup(net.ParseIP(test.ip))
+		if found != test.found || loc != test.loc {
+			t.Errorf("record size %d, ipv%d: lookup(%s) = %v, %v, want %v, %v",
+				db.recordSize, db.ipVersion, test.ip, loc, found, test.loc, test.found)
+		}
+	}
+}
+
+// a record can hold any value its size allows, 28 bit records share a nibble byte between them
+func TestMMDBReadNode(t *testing.T) {
+	var tests = []struct {
+		recordSize  int
+		left, right uint32
+	}{
+		{24, 0xABCDEF, 0x123456},
+		{28, 0xABCDEF1, 0x2345678},
+		{28, 0xF000000, 0x0000001},
+		{28, 0x0000001, 0xF000000},
+		{32, 0xFEDCBA98, 0x01234567},
+	}
+	for _, test := range tests {
+		var nodes = [][2]uint32{{1, 2}, {test.left, test.right}}
+		var db = &mmdbReader{tree: packTree(nodes, test.recordSize), nodeCount: 2, recordSize: test.recordSize}
+		if left, right := db.readNode(1, 0), db.readNode(1, 1); left != test.left || right != test.right {
+			t.Errorf("record size %d: read %x %x, want %x %x", test.recordSize, left, right, test.left, test.right)
+		}
+		if left, right := db.readNode(0, 0), db.readNode(0, 1); left != 1 || right != 2 {
+			t.Errorf("record size %d: first node read %x %x", test.recordSize, left, right)
+		}
+	}
+}
+
+// lookups end at the right record and records or pointers outside the data section find nothing
+func TestMMDBLookupIPv4(t *testing.T) {
+	var data []byte
+	var a = len(data)
+	data = append(data, encodeMap(encodeString("location"), encodeLocation(10, 20))...)
+	var shared = len(data)
+	data = append(data, encodeLocation(-30.5, 40.25)...)
+	var pointed = len(data)
+	data = append(data, encodeMap(encodeString("location"), encodePointer(shared))...)
+	var dangling = len(data)
+	data = append(data, encodeMap(encodeString("location"), encodePointer(len(data)+500))...)
+
+	const nodeCount = 4
+	var record = func(off int) uint32 { return uint32(nodeCount + mmdbDataSeparator + off) }
+	var nodes = [][2]uint32{
+		{1, 2},
+		{record(a), record(pointed)},             // 0.0.0.0/2 and 64.0.0.0/2
+		{record(dangling), 3},                    // 128.0.0.0/2
+		{record(len(data) + 100), nodeCount + 3}, // 192.0.0.0/3 past the data, 224.0.0.0/3 into the separator
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		var db = writeMMDB(t, nodes, data, recordSize, 4)
+		checkLookups(t, db, []mmdbLookupTest{
+			{"1.2.3.4", true, latLong{10, 20}},
+			{"63.255.255.255", true, latLong{10, 20}},
+			{"100.0.0.1", true, latLong{-30.5, 40.25}},
+			{"::ffff:100.0.0.1", true, latLong{-30.5, 40.25}},
+			{"130.0.0.1", false, latLong{}},
+			{"200.0.0.1", false, latLong{}},
+			{"230.0.0.1", false, latLong{}},
+			{"2001:db8::1", false, latLong{}},
+		})
+	}
+}
+
+// ipv4 addresses are looked up under ::/96 of an ipv6 tree
+func TestMMDBLookupIPv4InIPv6(t *testing.T) {
+	var data []byte
+	var v4low = len(data)
+	data = append(data, encodeMap(encodeString("location"), encodeLocation(1, 2))...)
+	var v4high = len(data)
+	data = append(data, encodeMap(encodeString("location"), encodeLocation(3, 4))...)
+	var v6 = len(data)
+	data = append(data, encodeMap(encodeString("location"), encodeLocation(5, 6))...)
+
+	// nodes 0 to 95 follow the zero bits of ::/96, node 96 is the root of the ipv4 subtree
+	const nodeCount = 97
+	var record = func(off int) uint32 { return uint32(nodeCount + mmdbDataSeparator + off) }
+	var nodes = make([][2]uint32, nodeCount)
+	nodes[0] = [2]uint32{1, record(v6)}
+	for i := 1; i < 96; i++ {
+		nodes[i] = [2]uint32{uint32(i + 1), nodeCount}
+	}
+	nodes[96] = [2]uint32{record(v4low), record(v4high)}
+	for _, recordSize := range []int{24, 28, 32} {
+		var db = writeMMDB(t, nodes, data, recordSize, 6)
+		if db.ipv4Start != 96 {
+			t.Errorf("record size %d: ipv4 subtree starts at node %d, want 96", recordSize, db.ipv4Start)
+		}
+		checkLookups(t, db, []mmdbLookupTest{
+			{"1.2.3.4", true, latLong{1, 2}},
+			{"::ffff:1.2.3.4", true, latLong{1, 2}},
+			{"::1.2.3.4", true, latLong{1, 2}},
+			{"200.1.1.1", true, latLong{3, 4}},
+			{"8000::1", true, latLong{5, 6}},
+			{"2001:db8::1", false, latLong{}},
+		})
+	}
+}
+
+// metadata the reader can't handle is rejected when the database is opened
+func TestMMDBOpenRejects(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "bad.mmdb")
+	var tests = []struct {
+		name string
+		file []byte
+	}{
+		{"no metadata", make([]byte, 64)},
+		{"record size", append(append(make([]byte, 32), mmdbMetadataMarker...), encodeMap(
+			encodeString("node_count"), encodeUint(1), encodeString("record_size"), encodeUint(20), encodeString("ip_version"), encodeUint(4))...)},
+		{"tree past the file", append(append(make([]byte, 32), mmdbMetadataMarker...), encodeMap(
+			encodeString("node_count"), encodeUint(100), encodeString("record_size"), encodeUint(24), encodeString("ip_version"), encodeUint(4))...)},
+		{"missing node count", append(append(make([]byte, 32), mmdbMetadataMarker...), encodeMap(
+			encodeString("record_size"), encodeUint(24), encodeString("ip_version"), encodeUint(4))...)},
+	}
+	for _, test := range tests {
+		if err := os.WriteFile(path, test.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openMMDB(path); err == nil {
+			t.Errorf("%s: opened, want an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policy used when none is given, measured rtts first and distance for the rest
+const defaultPolicy string = "rtt,geo"
+
+// how long it takes the answers counted against a host to halve for the least loaded policy
+const loadHalfLife = time.Minute
+
+// routingPolicy ranks the candidate host ips for a client, best first
+// a policy may leave out candidates it knows nothing about, the next policy in a chain ranks those
+type routingPolicy interface {
+	rank(r *router, client string, candidates []string) []string
+	name() string
+}
+
+// a policy whose ranking changes its own state, peek ranks the way rank would without changing it
+type statefulPolicy interface {
+	peek(r *router, client string, candidates []string) []string
+}
+
+// ranks hosts from closest to furthest from the client's geolocation
+type geoPolicy struct{}
+
+// ranks hosts that have measured the client's prefix by time decayed average rtt, leaving out the rest
+type rttPolicy struct{}
+
+// shuffles the hosts
+type randomPolicy struct{}
+
+// hands out hosts in turn, each as often as its weight relative to the others
+type roundRobinPolicy struct {
+	current map[string]int // host ips to their smooth round robin counters
+	mutex   sync.Mutex
+}
+
+// ranks hosts by how many answers have recently been handed out for them, fewest first
+type leastLoadedPolicy struct {
+	loads   map[string]float64 // host ips to exponentially decaying answer counts
+	updated time.Time
+	mutex   sync.Mutex
+}
+
+// tries each policy in order on the candidates the ones before it left out
+type chainPolicy []routingPolicy
+
+// parsePolicy builds the chain of policies for a comma separated list of policy names
+func parsePolicy(spec string) (routingPolicy, error) {
+	var chain chainPolicy
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "geo":
+			chain = append(chain, geoPolicy{})
+		case "rtt":
+			chain = append(chain, rttPolicy{})
+		case "random":
+			chain = append(chain, randomPolicy{})
+		case "wrr":
+			chain = append(chain, &roundRobinPolicy{current: make(map[string]int)})
+		case "load":
+			chain = append(chain, loadPolicy{})
+		case "least-loaded":
+			chain = append(chain, &leastLoadedPolicy{loads: make(map[string]float64), updated: time.Now()})
+		default:
+			return nil, errors.New("Unknown routing policy " + name + ", use geo, rtt, wrr, load, least-loaded or random")
+		}
+	}
+	// even a single policy is chained so candidates it leaves out are still handed out
+	return chain, nil
+}
+
+func (geoPolicy) rank(r *router, client string, candidates []string) []string {
+	var loc = r.locate(client)
+	var result = append([]string(nil), candidates...)
+	var distances = make(map[string]float64, len(result))
+	for _, server := range result {
+		distances[server] = distance(loc, r.hosts[server].loc)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return distances[result[i]] < distances[result[j]] })
+	return result
+}
+
+func (rttPolicy) rank(r *router, client string, candidates []string) []string {
+	var result = make([]string, 0, len(candidates))
+	var rtts = make(map[string]float64)
+	var ip = net.ParseIP(client)
+	for _, server := range candidates {
+		if rtt, in := r.rtts.estimate(ip, server); in {
+			result = append(result, server)
+			rtts[server] = rtt.avg
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return rtts[result[i]] < rtts[result[j]] })
+	return result
+}
+
+func (randomPolicy) rank(r *router, client string, candidates []string) []string {
+	var result = append([]string(nil), candidates...)
+	rand.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	return result
+}
+
+// rank uses smooth weighted round robin, every candidate's counter grows by its weight
+// and the largest counter wins, paying back the total weight so the others catch up
+// the rest follow by counter so extra answers are the hosts whose turn is next
+func (policy *roundRobinPolicy) rank(r *router, client string, candidates []string) []string {
+	if len(candidates) == 0 {
+		return nil
+	}
+	var result = append([]string(nil), candidates...)
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	var total = 0
+	for _, server := range result {
+		var weight = r.hosts[server].capacity()
+		policy.current[server] += weight
+		total += weight
+	}
+	sort.SliceStable(result, func(i, j int) bool { return policy.current[result[i]] > policy.current[result[j]] })
+	policy.current[result[0]] -= total
+	return result
+}
+
+// peek ranks by the counters the next answer would see, leaving them as they are
+func (policy *roundRobinPolicy) peek(r *router, client string, candidates []string) []string {
+	var result = append([]string(nil), candidates...)
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	var next = make(map[string]int, len(result))
+	for _, server := range result {
+		next[server] = policy.current[server] + r.hosts[server].capacity()
+	}
+	sort.SliceStable(result, func(i, j int) bool { return next[result[i]] > next[result[j]] })
+	return result
+}
+
+// rank charges the chosen host for the answer so the next client goes elsewhere
+func (policy *leastLoadedPolicy) rank(r *router, client string, candidates []string) []string {
+	if len(candidates) == 0 {
+		return nil
+	}
+	var result = append([]string(nil), candidates...)
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	var now = time.Now()
+	var decay = math.Exp2(-now.Sub(policy.updated).Seconds() / loadHalfLife.Seconds())
+	for server := range policy.loads {
+		policy.loads[server] *= decay
+	}
+	policy.updated = now
+	sort.SliceStable(result, func(i, j int) bool { return policy.loads[result[i]] < policy.loads[result[j]] })
+	policy.loads[result[0]]++
+	return result
+}
+
+// peek ranks by the decayed answer counts without charging the first host or storing the decay
+func (policy *leastLoadedPolicy) peek(r *router, client string, candidates []string) []string {
+	var result = append([]string(nil), candidates...)
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	// every count decays by the same factor, so the order is the same as after decaying them
+	sort.SliceStable(result, func(i, j int) bool { return policy.loads[result[i]] < policy.loads[result[j]] })
+	return result
+}
+
+func (chain chainPolicy) rank(r *router, client string, candidates []string) []string {
+	return chain.rankBy(r, client, candidates, nil, false)
+}
+
+// rankBy ranks the candidates like rank, recording the name of the policy that ranked each in rankedBy if it isn't nil
+// with dryRun set stateful policies peek instead, so the ranking changes nothing
+func (chain chainPolicy) rankBy(r *router, client string, candidates []string, rankedBy map[string]string, dryRun bool) []string {
+	var result = make([]string, 0, len(candidates))
+	var remaining = candidates
+	for _, policy := range chain {
+		if len(remaining) == 0 {
+			break
+		}
+		var ranked []string
+		if stateful, ok := policy.(statefulPolicy); ok && dryRun {
+			ranked = stateful.peek(r, client, remaining)
+		} else {
+			ranked = policy.rank(r, client, remaining)
+		}
+		for _, server := range ranked {
+			setRankedBy(rankedBy, server, policy.name())
+		}
+		result = append(result, ranked...)
+		remaining = without(remaining, ranked)
+	}
+	// whatever no policy ranked goes last in its original order
+	for _, server := range remaining {
+		setRankedBy(rankedBy, server, "unranked")
+	}
+	return append(result, remaining...)
+}
+
+func setRankedBy(rankedBy map[string]string, server, policy string) {
+	if rankedBy != nil {
+		rankedBy[server] = policy
+	}
+}
+
+func (geoPolicy) name() string          { return "geo" }
+func (rttPolicy) name() string          { return "rtt" }
+func (randomPolicy) name() string       { return "random" }
+func (*roundRobinPolicy) name() string  { return "wrr" }
+func (*leastLoadedPolicy) name() string { return "least-loaded" }
+func (loadPolicy) name() string         { return "load" }
+
+func (chain chainPolicy) name() string {
+	var names = make([]string, 0, len(chain))
+	for _, policy := range chain {
+		names = append(names, policy.name())
+	}
+	return strings.Join(names, ",")
+}
+
+// without returns the servers that are not in exclude
+func without(servers, exclude []string) []string {
+	var excluded = make(map[string]bool, len(exclude))
+	for _, server := range exclude {
+		excluded[server] = true
+	}
+	var result = make([]string, 0, len(servers))
+	for _, server := range servers {
+		if !excluded[server] {
+			result = append(result, server)
+		}
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"cdn/protocol"
+)
+
+// replicas join the hosts without the hosts file being edited by registering over a connection they
+// open to the registration port, the dns server takes the controller side of the handshake there,
+// after which the replica sends its registration and then a heartbeat every protocol.HeartbeatInterval
+// the registered host is dropped once the replica deregisters, or its connection ends or goes quiet
+// for protocol.RegistrationExpiry, and while registered it gets a control channel and health checks like
+// any host from the hosts file
+
+// a replica registered over a connection it holds open
+type registrant struct {
+	host *host
+	conn *protocol.Conn
+}
+
+// registrationServer accepts registrations until the listener fails, then signals done
+func registrationServer(listener *net.TCPListener, r *router, done chan bool) {
+	for {
+		connection, err := listener.AcceptTCP()
+		if errorCheck(err) {
+			done <- true
+			return
+		}
+		go r.handleRegistration(protocol.NewConn(connection, nil))
+	}
+}
+
+// handleRegistration adds the replica on conn to the hosts for as long as it keeps its registration alive
+func (r *router) handleRegistration(conn *protocol.Conn) {
+	defer conn.Close()
+	var remote = conn.RemoteAddr().(*net.TCPAddr).IP
+	if err := conn.ControllerHandshake(r.secret); err != nil {
+		fmt.Fprintln(os.Stderr, "Registration from", remote, "failed:", err)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(protocol.RegistrationExpiry))
+	var request protocol.Registration
+	if errorCheck(conn.ReadMessage(protocol.MsgRegister, &request)) {
+		return
+	}
+	var self *registrant
+	h, err := registrationHost(request, remote, r.port, r.geo)
+	if err == nil {
+		self = &registrant{h, conn}
+		err = r.register(self)
+	}
+	var reply protocol.Registered
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Rejecting registration from", remote, err)
+		reply.Error = err.Error()
+	}
+	conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	if errorCheck(conn.WriteMessage(protocol.MsgRegistered, reply)) || err != nil {
+		if err == nil {
+			r.deregister(self)
+		}
+		return
+	}
+	defer r.deregister(self)
+	for {
+		conn.SetReadDeadline(time.Now().Add(protocol.RegistrationExpiry))
+		typ, payload, err := conn.ReadFrame()
+		if err != nil {
+			fmt.Println("Lost registration of host", h.id, err)
+			return
+		} else if typ == protocol.MsgDeregister {
+			fmt.Println("Host", h.id, "deregistered")
+			return
+		}
+		var beat protocol.Heartbeat
+		if typ != protocol.MsgHeartbeat || errorCheck(json.Unmarshal(payload, &beat)) {
+			// message types added by newer replicas are skipped
+			continue
+		}
+		r.setDraining(self, beat.Draining)
+	}
+}
+
+// registrationHost validates the registration and builds its host the way hosts file entries are built,
+// a registration without addresses is for the address it came from
+func registrationHost(request protocol.Registration, remote net.IP, port int, geo geolocator) (*host, error) {
+	var config = hostConfig{
+		ID:          request.ID,
+		Addresses:   request.Addresses,
+		HTTPPort:    request.HTTPPort,
+		ControlPort: request.ControlPort,
+		Capacity:    request.Capacity,
+		Region:      request.Region,
+		Tags:        request.Tags,
+		Drain:       request.Draining}
+	if len(config.Addresses) == 0 {
+		config.Addresses = []string{remote.String()}
+	}
+	return config.toHost(port, geo)
+}
+
+// register adds the registered host, replacing an earlier registration from the same address
+// addresses of hosts in the hosts file can't be registered, the file has the final say
+func (r *router) register(registered *registrant) error {
+	r.registryMutex.Lock()
+	defer r.registryMutex.Unlock()
+	var key = registered.host.key()
+	if static, exists := r.static[key]; exists {
+		return errors.New("Address " + key + " belongs to host " + static.id + " in the hosts file")
+	}
+	if previous, exists := r.registered[key]; exists {
+		// the replica came back before its old registration expired
+		fmt.Println("Replacing registration of host", previous.host.id)
+		previous.conn.Close()
+	}
+	fmt.Println("Registered host", registered.host.id, key)
+	r.registered[key] = registered
+	r.rebuild()
+	return nil
+}
+
+// deregister removes the registered host, unless a newer registration from its address has replaced it
+func (r *router) deregister(registered *registrant) {
+	r.registryMutex.Lock()
+	defer r.registryMutex.Unlock()
+	var key = registered.host.key()
+	if r.registered[key] != registered {
+		return
+	}
+	delete(r.registered, key)
+	r.rebuild()
+}
+
+// setDraining puts the registered host in or out of the drain state
+func (r *router) setDraining(registered *registrant, draining bool) {
+	r.registryMutex.Lock()
+	defer r.registryMutex.Unlock()
+	var key = registered.host.key()
+	if r.registered[key] != registered || registered.host.draining.Load() == draining {
+		return
+	}
+	registered.host.draining.Store(draining)
+	// the live host is an earlier one when a registration replaced another at the same ports
+	r.hostsMutex.RLock()
+	defer r.hostsMutex.RUnlock()
+	if live, exists := r.hosts[key]; exists {
+		live.draining.Store(draining)
+	}
+	if draining {
+		fmt.Println("Host", registered.host.id, "is draining, leaving it out of new answers")
+	} else {
+		fmt.Println("Host", registered.host.id, "stopped draining, adding it back to answers")
+	}
+}
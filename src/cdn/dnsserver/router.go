@@ -1,26 +1,40 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"math"
 	"net"
 	"os"
-	"os/exec"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
-)
+	"sync/atomic"
 
-const ipSqlCommand string = "SELECT locations.latitude, locations.longitude FROM locations JOIN blocks ON blocks.locId = locations.locId WHERE %d BETWEEN blocks.startIpNum AND blocks.endIpNum LIMIT 1;"
-const dbName string = "locations.db"
+	"cdn/protocol"
+)
 
-// contains lat long of the host as well as the persistent TCP connection
+// contains the addresses and lat long of the host as well as its control channel
 type host struct {
-	loc  latLong
-	conn *net.TCPConn
+	id          string
+	ip4         net.IP // address handed out for A queries, nil if the host is ipv6 only
+	ip6         net.IP // address handed out for AAAA queries, nil if the host is ipv4 only
+	httpPort    int    // where the host serves http and its health path
+	controlPort int    // where the host accepts the control channel
+	region      string
+	tags        []string
+	loc         latLong
+	control     *controlConn
+	weight      int                      // capacity relative to the other hosts, from the hosts file
+	stop        chan bool                // closed once the host is removed, stopping its health checks
+	up          atomic.Bool              // whether the host passes its health checks
+	draining    atomic.Bool              // whether the host is finishing its clients and should get no new ones
+	load        atomic.Pointer[hostLoad] // the host's last load report, nil until it sends one
 }
 
+// number of measurements after which a host's rtt to a client is considered settled,
+// as long as their decayed weight hasn't fallen below that of one fresh measurement
+const stableSamples int = 3
+
 // represents a latitude longitude pair
 type latLong struct {
 	lat  float64
@@ -29,81 +43,276 @@ type latLong struct {
 
 // routing object for routing a client to an ec2 host
 type router struct {
-	hosts   map[string]host               // host ips to host structs
-	clients map[string]map[string]float64 // client ips to host ips to weighted rtts
-	mutex   sync.Mutex                    // mutex lock for clients map
+	hosts         map[string]*host       // host addresses to host structs, see host.key
+	hostsMutex    sync.RWMutex           // held for reading while routing and for writing while the hosts change
+	hostsFile     string                 // where the hosts are read from, reread by reload
+	static        map[string]*host       // the hosts from the hosts file
+	registered    map[string]*registrant // the hosts that registered themselves, never in static too
+	registryMutex sync.Mutex             // lock for static and registered, held while they are applied to hosts
+	dynamic       bool                   // whether replicas may register themselves
+	port          int                    // port of hosts that don't set their own
+	rtts          *measurementStore      // rtts from hosts to client prefixes
+	geo           geolocator             // where clients and hosts are
+	policy        routingPolicy          // ranks hosts for a client
+	secret        []byte                 // shared secret authenticating the control channels
+	// hosts each name and path prefix is hashed to when content affinity is on, 0 when it is off
+	affinity int
+	// whether _explain TXT queries are answered, they show anyone who asks how clients are routed
+	explainTXT bool
 }
 
-// initializes the router, given port should be the port ec2 http servers listen on
-func (r *router) init(port int) error {
-	r.hosts = make(map[string]host)
-	r.clients = make(map[string]map[string]float64)
-	return r.parseEC2AndConnect(port)
+// initializes the router with the hosts in the config's hosts file, its port is used for hosts that don't set their own
+// if replicas may register themselves the hosts file may be empty or missing
+func (r *router) init(config *serverConfig) error {
+	r.hostsFile = config.hostsFile
+	r.port = config.port
+	r.geo = config.geo
+	r.policy = config.policy
+	r.rtts = config.rtts
+	r.secret = config.secret
+	r.affinity = config.affinity
+	r.dynamic = config.registerPort != 0
+	r.explainTXT = config.explainTXT
+	r.hosts = make(map[string]*host)
+	r.static = make(map[string]*host)
+	r.registered = make(map[string]*registrant)
+	hosts, err := loadHosts(r.hostsFile, r.port, r.geo)
+	if r.dynamic && os.IsNotExist(err) {
+		fmt.Println("No hosts file at", r.hostsFile, "waiting for replicas to register")
+		return nil
+	} else if err != nil {
+		return err
+	} else if len(hosts) == 0 && !r.dynamic {
+		return errors.New("Hosts file " + r.hostsFile + " has no hosts and replicas can't register themselves")
+	}
+	r.registryMutex.Lock()
+	defer r.registryMutex.Unlock()
+	r.static = hosts
+	r.rebuild()
+	return nil
 }
 
-// parses the ec2-hosts.txt file
-// attempts to establish tcp connections with each host
-// starts up threads for reading from connections
-func (r *router) parseEC2AndConnect(port int) error {
-	file, err := os.Open("ec2-hosts.txt")
+// reload rereads the hosts file, keeping the current hosts if it has become invalid
+// registered replicas whose address is now in the hosts file are dropped in favor of the file
+func (r *router) reload() error {
+	hosts, err := loadHosts(r.hostsFile, r.port, r.geo)
 	if err != nil {
 		return err
+	} else if len(hosts) == 0 && !r.dynamic {
+		return errors.New("Hosts file " + r.hostsFile + " has no hosts and replicas can't register themselves")
+	}
+	r.registryMutex.Lock()
+	defer r.registryMutex.Unlock()
+	r.static = hosts
+	for key, registered := range r.registered {
+		if static, exists := hosts[key]; exists {
+			fmt.Println("Dropping registration of", registered.host.id, "its address belongs to host", static.id)
+			delete(r.registered, key)
+			registered.conn.Close()
+		}
+	}
+	r.rebuild()
+	return nil
+}
+
+// rebuild applies the hosts from the hosts file and the registered hosts, the caller holds the registry lock
+func (r *router) rebuild() {
+	var hosts = make(map[string]*host, len(r.static)+len(r.registered))
+	for key, h := range r.static {
+		hosts[key] = h
 	}
-	defer file.Close()
-	var scanner = bufio.NewScanner(file)
-	for scanner.Scan() {
-		var text = scanner.Text()
-		if strings.Contains(text, "Origin") || strings.HasPrefix(text, "#") {
+	for key, registered := range r.registered {
+		hosts[key] = registered.host
+	}
+	r.applyHosts(hosts)
+}
+
+// applyHosts replaces the router's hosts with hosts
+// hosts that are still there at the same ports keep their health, load and control channel and take
+// on their new settings, removed hosts have their control channels and health checks stopped,
+// and new hosts start theirs, hosts that can't be reached yet connect once they come up
+// the rings are handed to the control channels after the lock is released, so queries never wait on replicas
+func (r *router) applyHosts(hosts map[string]*host) {
+	r.hostsMutex.Lock()
+	for key, old := range r.hosts {
+		var updated, in = hosts[key]
+		if in && updated.httpPort == old.httpPort && updated.controlPort == old.controlPort {
+			old.id, old.ip6, old.region, old.tags = updated.id, updated.ip6, updated.region, updated.tags
+			old.loc, old.weight = updated.loc, updated.weight
+			old.draining.Store(updated.draining.Load())
+			hosts[key] = old
 			continue
 		}
-		var line = strings.Split(text, "\t")
-		var url = strings.Split(line[0], "-")
-		var ip = strings.Join([]string{url[1], url[2], url[3], strings.Split(url[4], ".")[0]}, ".")
-		var conn, err = net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
-		if err != nil {
-			return err
+		fmt.Println("Removing host", old.id, key)
+		close(old.stop)
+		old.control.close()
+	}
+	var previous = r.hosts
+	r.hosts = hosts
+	for key, h := range hosts {
+		if previous[key] == h {
+			continue
 		}
-		r.hosts[ip] = host{getLatLong(ip), conn}
-		go r.getPingResponses(ip)
+		fmt.Println("Adding host", h.id, key)
+		h.stop = make(chan bool)
+		h.control = newControlConn(&net.TCPAddr{IP: net.ParseIP(key), Port: h.controlPort}, r.secret)
+		go h.control.supervise(controlHandlers{
+			ping:    func(result protocol.PingResult) { r.handlePingResult(key, result) },
+			passive: func(report protocol.PassiveReport) { r.handlePassiveReport(key, report) },
+			load:    h.handleLoadReport})
+		go checkHealth(h)
 	}
-	return nil
+	// a host coming or going can change which hosts are nearest to any replica, so every replica gets its ring again
+	var rings = make(map[*controlConn]*protocol.AffinityRing, len(hosts))
+	for key, h := range hosts {
+		rings[h.control] = r.ring(key)
+	}
+	r.hostsMutex.Unlock()
+	for control, ring := range rings {
+		control.setRing(ring)
+	}
+}
+
+// key returns the address the host is known by, its ipv4 address if it has one
+func (h *host) key() string {
+	if h.ip4 != nil {
+		return h.ip4.String()
+	}
+	return h.ip6.String()
 }
 
-// gets the server ip to respond with for the given client ip
-func (r *router) getServer(ip string) string {
-	var servers, exists = r.clients[ip]
-	var result = ""
-	// if the client has never been seen before return closest server
-	if !exists || len(servers) == 0 {
-		result = r.getClosestServer(ip)
-	} else {
-		// otherwise return server with minimum weighted average rtt for client
-		var minRTT = 0.0
-		for server, rtt := range servers {
-			if minRTT == 0.0 || rtt < minRTT {
-				minRTT = rtt
-				result = server
-			}
+// address returns the server's address of the requested family, and whether the server is still a host
+func (r *router) address(server string, ipv6 bool) (net.IP, bool) {
+	r.hostsMutex.RLock()
+	defer r.hostsMutex.RUnlock()
+	var h, exists = r.hosts[server]
+	if !exists {
+		return nil, false
+	} else if ipv6 {
+		return h.ip6, true
+	}
+	return h.ip4, true
+}
+
+// canServe returns whether the host has an address of the requested family
+func (h *host) canServe(ipv6 bool) bool {
+	if ipv6 {
+		return h.ip6 != nil
+	}
+	return h.ip4 != nil
+}
+
+// inPool returns whether the host is one of the pool's entries, an empty pool holds every host
+func inPool(h *host, pool []string) bool {
+	if len(pool) == 0 {
+		return true
+	}
+	for _, entry := range pool {
+		if h.matches(entry) {
+			return true
 		}
 	}
-	// send out ping requests for client in another thread
-	go r.sendPingRequests(ip)
+	return false
+}
+
+// matches returns whether a pool entry names the host, by its id or either of its addresses
+func (h *host) matches(entry string) bool {
+	return entry == h.id || h.ip4 != nil && entry == h.ip4.String() || h.ip6 != nil && entry == h.ip6.String()
+}
+
+// knowsHost returns whether a pool entry names one of the hosts, the caller must hold the hosts lock
+func (r *router) knowsHost(entry string) bool {
+	for _, h := range r.hosts {
+		if h.matches(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// gets up to n server ips from the pool for the given client ip, best first as ranked by the routing policy
+// the routing policies run with the hosts locked for reading
+// with affinity on, the hosts the name hashes to among the nearby ones go first,
+// and hosts well over their share of the load go after the ones with spare capacity
+func (r *router) getServers(ip string, ipv6 bool, n int, pool []string, affinity affinity) []string {
+	r.hostsMutex.RLock()
+	defer r.hostsMutex.RUnlock()
+	var candidates, _ = r.candidates(ipv6, pool)
+	var result = r.preferSpare(affinity.apply(r.policy.rank(r, ip, candidates)))
+	if len(result) > n {
+		result = result[:n]
+	}
+	// send out ping requests for client in another thread, unless its network was measured or asked about lately
+	if r.rtts.shouldProbe(net.ParseIP(ip)) {
+		go r.sendPingRequests(ip)
+	}
 	return result
 }
 
-// gets the closest server for the given client ip
-func (r *router) getClosestServer(ip string) string {
-	var loc = getLatLong(ip)
-	var minDistance = 0.0
-	var closest = ""
-	for ip, host := range r.hosts {
-		var dist = distance(loc, host.loc)
-		if minDistance == 0.0 || dist < minDistance {
-			minDistance = dist
-			closest = ip
+// candidates returns the hosts in the pool that can be handed out for the address family, sorted,
+// along with why each of the other hosts was left out, the caller must hold the hosts lock
+// hosts failing their health checks are left out unless every host in the pool is down,
+// in which case handing out a host that may have recovered beats handing out nothing,
+// and draining hosts are left out unless every host in the pool is draining, they still serve until they leave
+func (r *router) candidates(ipv6 bool, pool []string) ([]string, map[string]string) {
+	var candidates = make([]string, 0, len(r.hosts))
+	var down = make([]string, 0)
+	var draining = make([]string, 0)
+	var excluded = make(map[string]string)
+	for server, host := range r.hosts {
+		if !host.canServe(ipv6) {
+			excluded[server] = "no address of the family"
+		} else if !inPool(host, pool) {
+			excluded[server] = "not in the name's pool"
+		} else if host.draining.Load() {
+			draining = append(draining, server)
+		} else if host.up.Load() {
+			candidates = append(candidates, server)
+		} else {
+			down = append(down, server)
 		}
 	}
-	return closest
+	if len(candidates) == 0 {
+		candidates, down = down, nil
+	}
+	if len(candidates) == 0 {
+		candidates, draining = draining, nil
+	}
+	for _, server := range down {
+		excluded[server] = "down"
+	}
+	for _, server := range draining {
+		excluded[server] = "draining"
+	}
+	// map order is random, keep ties between hosts stable
+	sort.Strings(candidates)
+	return candidates, excluded
+}
+
+// confidence returns how settled the routing for the client is, from 0 when none of the hosts it can be
+// handed for the address family has measured it recently up to 1 when every one of them has sent enough
+// recent measurements
+func (r *router) confidence(ip string, ipv6 bool, pool []string) float64 {
+	r.hostsMutex.RLock()
+	defer r.hostsMutex.RUnlock()
+	var candidates, _ = r.candidates(ipv6, pool)
+	if len(candidates) == 0 {
+		return 0.0
+	}
+	var client = net.ParseIP(ip)
+	var stable = 0
+	for _, server := range candidates {
+		if rtt, in := r.rtts.estimate(client, server); in && rtt.samples >= stableSamples && rtt.weight >= 1 {
+			stable++
+		}
+	}
+	return float64(stable) / float64(len(candidates))
+}
+
+// locate returns the lat long of the given ip, clients that can't be located are treated as being at 0, 0
+func (r *router) locate(ip string) latLong {
+	var loc, _ = r.geo.lookup(net.ParseIP(ip))
+	return loc
 }
 
 // uses the haversine formula to determine distance between two lat-long points
@@ -121,82 +330,40 @@ func haversine(diff float64) float64 {
 	return math.Pow(math.Sin(diff/2), 2)
 }
 
-func ipStringToInt(ipstr string) int {
-	if ipstr == "" {
-		return 0
-	}
-	parts := strings.Split(ipstr, ".")
-	if len(parts) != 4 {
-		fmt.Fprintln(os.Stderr, "Encountered non-ipv4 address:", ipstr)
-		return -1
+// sends out requests for all ec2 hosts to ping the given ip
+func (r *router) sendPingRequests(ip string) {
+	r.hostsMutex.RLock()
+	var controls = make(map[string]*controlConn, len(r.hosts))
+	for hostIP, host := range r.hosts {
+		controls[hostIP] = host.control
 	}
-	first, err := strconv.ParseInt(parts[0], 10, 32)
-	second, err2 := strconv.ParseInt(parts[1], 10, 32)
-	third, err3 := strconv.ParseInt(parts[2], 10, 32)
-	fourth, err4 := strconv.ParseInt(parts[3], 10, 32)
-	if errorCheck(err) || errorCheck(err2) || errorCheck(err3) || errorCheck(err4) {
-		return -1
+	r.hostsMutex.RUnlock()
+	for hostIP, control := range controls {
+		// hosts that are down are skipped, their supervisor is already reconnecting
+		if err := control.requestPing(ip); err != nil && err != errNotConnected {
+			fmt.Fprintln(os.Stderr, "Could not send ping request to http server: ", hostIP, err)
+		}
 	}
-	return int((first << 24) + (second << 16) + (third << 8) + fourth)
 }
 
-// gets the latitude and longitude for the given ip using external database
-func getLatLong(ip string) latLong {
-	ipInt := ipStringToInt(ip)
-	sqlite3 := exec.Command("sqlite3", dbName, fmt.Sprintf(ipSqlCommand, ipInt))
-	out, err := sqlite3.Output()
-	if errorCheck(err) {
-		return latLong{0.0, 0.0}
-	}
-	latLongFields := strings.Split(string(out), "|")
-	if len(latLongFields) != 2 {
-		fmt.Println("No suitable lat long found for", ip)
-		return latLong{0.0, 0.0}
+// handlePingResult adds a ping result from the given host to the rtt of the client's prefix
+// results for clients the host couldn't reach carry no rtt and are left out
+func (r *router) handlePingResult(ip string, result protocol.PingResult) {
+	var client = net.ParseIP(result.Client)
+	if result.Loss >= 1.0 || result.RTT <= 0 || client == nil {
+		return
 	}
-	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latLongFields[0]), 64)
-	long, err2 := strconv.ParseFloat(strings.TrimSpace(latLongFields[1]), 64)
-	if errorCheck(err1) || errorCheck(err2) {
-		return latLong{0.0, 0.0}
-	}
-	return latLong{lat, long}
+	r.rtts.add(client, ip, result.RTT)
 }
 
-// sends out requests for all ec2 hosts to ping the given ip
-func (r *router) sendPingRequests(ip string) {
-	var toSend = []byte(ip + "\n")
-	for _, host := range r.hosts {
-		host.conn.Write(toSend)
-	}
-}
-
-func (r *router) getPingResponses(ip string) {
-	var conn = r.hosts[ip].conn
-	var connReader = bufio.NewReader(conn)
-	for {
-		line, err := connReader.ReadString('\n')
-		if errorCheck(err) {
-			break
-		}
-		var splitLine = strings.Fields(strings.Replace(line, "\n", "", -1))
-		if len(splitLine) != 2 {
-			fmt.Fprintln(os.Stderr, "Could not parse ping response for http server: ", ip)
-			continue
-		}
-		var clientIP = splitLine[0]
-		rtt, err := strconv.ParseFloat(splitLine[1], 64)
-		if errorCheck(err) {
+// handlePassiveReport adds the rtts the given host saw on connections from client prefixes
+func (r *router) handlePassiveReport(ip string, report protocol.PassiveReport) {
+	for _, prefix := range report.Prefixes {
+		if prefix.RTT <= 0 || prefix.Samples < 1 {
 			continue
 		}
-
-		r.mutex.Lock()
-		if _, in := r.clients[clientIP]; !in {
-			r.clients[clientIP] = make(map[string]float64)
-		}
-		if avgRTT, in := r.clients[clientIP][ip]; in {
-			r.clients[clientIP][ip] = (avgRTT + rtt) / 2.0
-		} else {
-			r.clients[clientIP][ip] = rtt
+		if err := r.rtts.addReport(prefix.Prefix, ip, prefix.RTT); err != nil {
+			fmt.Fprintln(os.Stderr, "Dropping passive rtt from", ip, err)
 		}
-		r.mutex.Unlock()
 	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// dns messages over tcp are prefixed with a 16 bit length
+const maxTCPMessage int = 65535
+
+// connections that send nothing for this long, or won't take a response for this long, are closed
+const tcpIdleTimeout = 10 * time.Second
+
+// bounds on the work tcp clients can start, so a few of them can't hold every thread
+const (
+	maxTCPConnections     int = 1024 // open connections, more are closed as soon as they are accepted
+	maxTCPQueriesInFlight int = 16   // queries answered at once per connection, reading waits for a free one
+)
+
+// tcpServer accepts dns connections until the listener fails, then signals done
+func tcpServer(listener *net.TCPListener, zones *zoneTable, r *router, done chan bool) {
+	var open = make(chan bool, maxTCPConnections)
+	for {
+		connection, err := listener.AcceptTCP()
+		if errorCheck(err) {
+			done <- true
+			return
+		}
+		select {
+		case open <- true:
+		default:
+			connection.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-open }()
+			handleTCPConnection(connection, zones, r)
+		}()
+	}
+}
+
+// handleTCPConnection reads length prefixed queries off the connection until it is closed or idle
+// queries are answered in their own threads so pipelined queries don't wait on each other,
+// which means responses may be written in a different order than the queries arrived
+func handleTCPConnection(connection *net.TCPConn, zones *zoneTable, r *router) {
+	defer connection.Close()
+	var client = connection.RemoteAddr().(*net.TCPAddr).IP
+	var inFlight = make(chan bool, maxTCPQueriesInFlight)
+	var writeMutex sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var lengthBuffer = make([]byte, 2)
+	for {
+		connection.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(connection, lengthBuffer); err != nil {
+			if err != io.EOF {
+				errorCheck(err)
+			}
+			return
+		}
+		var query = make([]byte, binary.BigEndian.Uint16(lengthBuffer))
+		if _, err := io.ReadFull(connection, query); errorCheck(err) {
+			return
+		}
+		inFlight <- true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			var response = handleQuery(query, client, true, zones, r)
+			if response == nil {
+				return
+			}
+			var framed = binary.BigEndian.AppendUint16(make([]byte, 0, len(response)+2), uint16(len(response)))
+			framed = append(framed, response...)
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			connection.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+			_, err := connection.Write(framed)
+			errorCheck(err)
+		}()
+	}
+}
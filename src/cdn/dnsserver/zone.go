@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// SOA timers for the served zone, the minimum doubles as the negative caching ttl
+const (
+	soaRefresh uint32 = 3600
+	soaRetry   uint32 = 600
+	soaExpire  uint32 = 86400
+	soaMinimum uint32 = 60
+)
+
+// ttl handed out with the zone's NS records and their glue
+const nsTTL uint32 = 86400
+
+// soaSerial is fixed at startup so every SOA handed out by this process agrees
+var soaSerial = uint32(time.Now().Unix())
+
+// an authoritative name server for the zone along with its glue addresses
+type nameserver struct {
+	name string
+	ips  []net.IP
+}
+
+// a name served inside a zone, either routed to a pool of hosts or an alias for another name
+type zoneRecord struct {
+	name  string   // fully qualified, a leading *. label makes it a wildcard
+	hosts []string // ids or canonical addresses of the hosts the name is routed to, every host if empty
+	cname string   // target of the alias, empty for routed names
+}
+
+// a zone this dns server is authoritative for
+type zone struct {
+	name        string
+	nameservers []nameserver
+	minTTL      uint32 // ttl for answers to clients the router is still measuring
+	maxTTL      uint32 // ttl for answers to clients every host has settled rtts for
+	answers     int    // number of ranked servers handed out per A or AAAA answer
+	affinity    int    // hosts each name is hashed to among the client's nearby hosts, 0 for no affinity
+	records     map[string]*zoneRecord
+}
+
+// every zone served by this dns server
+type zoneTable struct {
+	zones []*zone
+}
+
+// the json zones file, ttls, answers and affinity left out fall back to the command line values
+type zonesConfig struct {
+	Zones []struct {
+		Name        string   `json:"name"`
+		Nameservers []string `json:"nameservers"` // name=ip[=ip...] entries
+		MinTTL      uint32   `json:"ttl_min"`
+		MaxTTL      uint32   `json:"ttl_max"`
+		Answers     int      `json:"answers"`
+		Affinity    *int     `json:"affinity"` // 0 turns affinity off for the zone
+		Records     []struct {
+			Name  string   `json:"name"`  // relative to the zone, @ for the apex
+			Hosts []string `json:"hosts"` // host ids or addresses
+			CNAME string   `json:"cname"`
+		} `json:"records"`
+	} `json:"zones"`
+}
+
+// newZone creates the zone for name, nameservers is a comma separated list of name=ip[=ip...] entries
+// if no nameservers are given the zone is served by ns1.<name> on this machine's addresses
+// affinity is the number of hosts each name is hashed to, 0 to route names without affinity
+func newZone(name string, nameservers string, minTTL, maxTTL uint32, answers int, affinity int) (*zone, error) {
+	if minTTL > maxTTL {
+		return nil, errors.New("Minimum answer ttl must not be larger than the maximum")
+	} else if answers < 1 {
+		return nil, errors.New("Answers must hand out at least one server")
+	} else if affinity < 0 {
+		return nil, errors.New("Affinity must not be negative")
+	}
+	var z = &zone{
+		name:     strings.TrimSuffix(strings.ToLower(name), "."),
+		minTTL:   minTTL,
+		maxTTL:   maxTTL,
+		answers:  answers,
+		affinity: affinity,
+		records:  make(map[string]*zoneRecord)}
+	for _, entry := range strings.Split(nameservers, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var fields = strings.Split(entry, "=")
+		var ns = nameserver{name: strings.TrimSuffix(strings.ToLower(fields[0]), ".")}
+		for _, ipstr := range fields[1:] {
+			var ip = net.ParseIP(ipstr)
+			if ip == nil {
+				return nil, errors.New("Invalid glue address " + ipstr + " for name server " + ns.name)
+			}
+			ns.ips = append(ns.ips, ip)
+		}
+		if inZone(ns.name, z.name) && len(ns.ips) == 0 {
+			return nil, errors.New("Name server " + ns.name + " is inside the zone and needs a glue address")
+		}
+		z.nameservers = append(z.nameservers, ns)
+	}
+	if len(z.nameservers) == 0 {
+		var ips, err = localAddresses()
+		if err != nil {
+			return nil, err
+		}
+		z.nameservers = append(z.nameservers, nameserver{"ns1." + z.name, ips})
+	}
+	return z, nil
+}
+
+// loadZones reads the zones file at path, using the given ttls, answer count and affinity where a zone has none
+func loadZones(path string, minTTL, maxTTL uint32, answers int, affinity int) (*zoneTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var config zonesConfig
+	if err = json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, errors.New("Could not parse zones file " + path + ": " + err.Error())
+	}
+	var table = &zoneTable{}
+	for _, zc := range config.Zones {
+		if zc.MinTTL == 0 && zc.MaxTTL == 0 {
+			zc.MinTTL, zc.MaxTTL = minTTL, maxTTL
+		}
+		if zc.Answers == 0 {
+			zc.Answers = answers
+		}
+		if zc.Affinity == nil {
+			zc.Affinity = &affinity
+		}
+		z, err := newZone(zc.Name, strings.Join(zc.Nameservers, ","), zc.MinTTL, zc.MaxTTL, zc.Answers, *zc.Affinity)
+		if err != nil {
+			return nil, errors.New("Zone " + zc.Name + ": " + err.Error())
+		}
+		for _, rc := range zc.Records {
+			if err = z.addRecord(rc.Name, rc.Hosts, rc.CNAME); err != nil {
+				return nil, errors.New("Zone " + zc.Name + ": " + err.Error())
+			}
+		}
+		table.zones = append(table.zones, z)
+	}
+	if len(table.zones) == 0 {
+		return nil, errors.New("Zones file " + path + " does not define any zones")
+	}
+	return table, nil
+}
+
+// addRecord adds a name relative to the zone, routed to hosts unless cname is set
+func (z *zone) addRecord(name string, hosts []string, cname string) error {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "@" || name == "" {
+		name = z.name
+	} else {
+		name += "." + z.name
+	}
+	if _, exists := z.records[name]; exists {
+		return errors.New("Duplicate record " + name)
+	} else if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return errors.New("Wildcards are only allowed as the first label in " + name)
+	} else if cname != "" && len(hosts) > 0 {
+		return errors.New("Record " + name + " can't be both an alias and routed to hosts")
+	} else if cname != "" && name == z.name {
+		return errors.New("The zone apex can't be an alias")
+	}
+	var pool = make([]string, 0, len(hosts))
+	for _, entry := range hosts {
+		// addresses are stored the way host keys print them, so 2001:DB8::12 matches 2001:db8::12
+		if ip := net.ParseIP(entry); ip != nil {
+			entry = ip.String()
+		} else if entry == "" {
+			return errors.New("Record " + name + " has an empty host")
+		}
+		pool = append(pool, entry)
+	}
+	var target = strings.TrimSuffix(strings.ToLower(cname), ".")
+	z.records[name] = &zoneRecord{name, pool, target}
+	return nil
+}
+
+// find returns the most specific zone domain is in, or nil if we are not authoritative for it
+func (table *zoneTable) find(domain string) *zone {
+	var result *zone
+	for _, z := range table.zones {
+		if inZone(domain, z.name) && (result == nil || len(z.name) > len(result.name)) {
+			result = z
+		}
+	}
+	return result
+}
+
+// checkHosts makes sure every host named by a record is one the router knows about
+func (table *zoneTable) checkHosts(r *router) error {
+	r.hostsMutex.RLock()
+	defer r.hostsMutex.RUnlock()
+	for _, z := range table.zones {
+		for _, record := range z.records {
+			for _, entry := range record.hosts {
+				if !r.knowsHost(entry) {
+					return errors.New("Record " + record.name + " uses unknown host " + entry)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns the record for domain, falling back to the closest wildcard above it
+// names that exist, even only as empty non terminals, are never matched by a wildcard (rfc 4592)
+func (z *zone) lookup(domain string) *zoneRecord {
+	if record, exists := z.records[domain]; exists {
+		return record
+	} else if z.hasDescendant(domain) {
+		return nil
+	}
+	for parent := domain; parent != z.name && strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if record, exists := z.records["*."+parent]; exists {
+			return record
+		} else if _, exists := z.records[parent]; exists || z.hasDescendant(parent) {
+			// an existing name blocks wildcards further up from matching below it
+			return nil
+		}
+	}
+	return nil
+}
+
+// hasDescendant returns whether some record lives below domain, making it an empty non terminal
+func (z *zone) hasDescendant(domain string) bool {
+	for name := range z.records {
+		if strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// localAddresses returns the public addresses of this machine, which the default name server is glued to
+func localAddresses() ([]net.IP, error) {
+	var addrs, err = net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var result = glueAddresses(addrs)
+	if len(result) == 0 {
+		return nil, errors.New("No public address to use as glue, pass name servers explicitly with -ns")
+	}
+	return result, nil
+}
+
+// glueAddresses returns the interface addresses resolvers anywhere can reach, leaving out private,
+// reserved and link local ones, a machine behind nat such as an ec2 instance may have none
+func glueAddresses(addrs []net.Addr) []net.IP {
+	var result []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && publicAddress(ipnet.IP) {
+			result = append(result, ipnet.IP)
+		}
+	}
+	return result
+}
+
+// inZone returns whether domain is the zone apex or one of its subdomains
+func inZone(domain, zone string) bool {
+	return domain == zone || strings.HasSuffix(domain, "."+zone)
+}
+
+// answerTTL scales the ttl of a routed answer with how confident the router is in it
+// clients still being measured come back soon to pick up a better server, settled clients can cache longer
+func (z *zone) answerTTL(confidence float64) uint32 {
+	confidence = math.Max(0.0, math.Min(1.0, confidence))
+	return z.minTTL + uint32(confidence*float64(z.maxTTL-z.minTTL))
+}
+
+// getNameserver returns the zone's name server called domain, or nil if there is none
+func (z *zone) getNameserver(domain string) *nameserver {
+	for i := range z.nameservers {
+		if z.nameservers[i].name == domain {
+			return &z.nameservers[i]
+		}
+	}
+	return nil
+}
+
+// soa builds the start of authority record for the zone
+func (z *zone) soa() *dnsRecord {
+	var rdata = &soaRdata{
+		domainToByteArrays(z.nameservers[0].name),
+		domainToByteArrays("hostmaster." + z.name),
+		soaSerial,
+		soaRefresh,
+		soaRetry,
+		soaExpire,
+		soaMinimum}
+	// negative answers may be cached for the soa minimum
+	return &dnsRecord{domainToByteArrays(z.name), typeSOA, classIN, soaMinimum, rdata}
+}
+
+// nsRecords builds the NS records for the zone apex
+func (z *zone) nsRecords() []*dnsRecord {
+	var result = make([]*dnsRecord, 0, len(z.nameservers))
+	for _, ns := range z.nameservers {
+		var rdata = nameRdata(domainToByteArrays(ns.name))
+		result = append(result, &dnsRecord{domainToByteArrays(z.name), typeNS, classIN, nsTTL, rdata})
+	}
+	return result
+}
+
+// addressRecords builds A or AAAA records for the name server's addresses
+func (ns *nameserver) addressRecords(qtype uint16) []*dnsRecord {
+	var result = make([]*dnsRecord, 0, len(ns.ips))
+	for _, ip := range ns.ips {
+		if ip4 := ip.To4(); ip4 != nil && qtype == typeA {
+			result = append(result, &dnsRecord{domainToByteArrays(ns.name), typeA, classIN, nsTTL, rawRdata(ip4)})
+		} else if ip4 == nil && qtype == typeAAAA {
+			result = append(result, &dnsRecord{domainToByteArrays(ns.name), typeAAAA, classIN, nsTTL, rawRdata(ip.To16())})
+		}
+	}
+	return result
+}
+
+// glue builds the address records for name servers that live inside the zone
+func (z *zone) glue() []*dnsRecord {
+	var result []*dnsRecord
+	for _, ns := range z.nameservers {
+		if inZone(ns.name, z.name) {
+			result = append(result, ns.addressRecords(typeA)...)
+			result = append(result, ns.addressRecords(typeAAAA)...)
+		}
+	}
+	return result
+}
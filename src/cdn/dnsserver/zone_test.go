@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// only addresses resolvers anywhere can reach are used as glue for the default name server
+func TestGlueAddresses(t *testing.T) {
+	var tests = []struct {
+		addr string
+		glue bool
+	}{
+		{"8.8.8.8/24", true},
+		{"2600::1/64", true},
+		{"10.0.0.5/8", false},
+		{"172.16.1.1/12", false},
+		{"192.168.1.10/24", false},
+		{"100.64.0.1/10", false},
+		{"127.0.0.1/8", false},
+		{"169.254.1.1/16", false},
+		{"fd00::1/64", false},
+		{"fe80::1/64", false},
+		{"::1/128", false},
+	}
+	for _, test := range tests {
+		var ip, ipnet, _ = net.ParseCIDR(test.addr)
+		ipnet.IP = ip
+		var glue = glueAddresses([]net.Addr{ipnet})
+		if len(glue) == 1 != test.glue {
+			t.Errorf("glueAddresses(%s) = %v, want glue %v", test.addr, glue, test.glue)
+		}
+	}
+}
+
+// pool entries name hosts by id or by any spelling of either of their addresses
+func TestPoolEntries(t *testing.T) {
+	var z, err = newZone("cdn.example.com", "ns1.cdn.example.com=192.0.2.53", 5, 300, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dual = &host{id: "us-east", ip4: net.ParseIP("192.0.2.10").To4(), ip6: net.ParseIP("2001:db8::10")}
+	var v6 = &host{id: "ap-south", ip6: net.ParseIP("2001:db8::12")}
+	var r = &router{hosts: map[string]*host{dual.key(): dual, v6.key(): v6}}
+	var tests = []struct {
+		entry  string
+		member *host
+	}{
+		{"us-east", dual},
+		{"192.0.2.10", dual},
+		{"2001:db8::10", dual},
+		{"2001:DB8:0::10", dual},
+		{"ap-south", v6},
+		{"2001:DB8::12", v6},
+		{"192.0.2.12", nil},
+		{"eu-west", nil},
+	}
+	for i, test := range tests {
+		var name = "n" + strconv.Itoa(i)
+		if err := z.addRecord(name, []string{test.entry}, ""); err != nil {
+			t.Fatalf("addRecord(%s): %v", test.entry, err)
+		}
+		var pool = z.records[name+".cdn.example.com"].hosts
+		if r.knowsHost(pool[0]) != (test.member != nil) {
+			t.Errorf("%s: known %v, want %v", test.entry, r.knowsHost(pool[0]), test.member != nil)
+		}
+		for _, h := range []*host{dual, v6} {
+			if inPool(h, pool) != (h == test.member) {
+				t.Errorf("%s: host %s in pool %v, want %v", test.entry, h.id, inPool(h, pool), h == test.member)
+			}
+		}
+	}
+	if err := z.addRecord("empty", []string{""}, ""); err == nil {
+		t.Error("addRecord with an empty host succeeded")
+	}
+}
+
+// names match their own record first, then the closest wildcard above them unless an existing name is in the way
+func TestZoneLookup(t *testing.T) {
+	var z, err = newZone("cdn.example.com", "ns1.cdn.example.com=192.0.2.53", 5, 300, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []struct{ name, cname string }{
+		{"@", ""}, {"*", ""}, {"*.img", ""}, {"a.img", ""}, {"x.y.z", ""}, {"*.alias", "cdn.example.org."}, {"WWW", "CDN.example.com"},
+	} {
+		if err := z.addRecord(record.name, nil, record.cname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		domain     string
+		record     string // name of the record found, empty for none
+		descendant bool   // whether the name has records below it
+	}{
+		{"cdn.example.com", "cdn.example.com", true},
+		{"www.cdn.example.com", "www.cdn.example.com", false},
+		{"b.img.cdn.example.com", "*.img.cdn.example.com", false},
+		{"c.b.img.cdn.example.com", "*.img.cdn.example.com", false},
+		{"img.cdn.example.com", "", true},
+		{"a.img.cdn.example.com", "a.img.cdn.example.com", false},
+		{"x.a.img.cdn.example.com", "", false},
+		{"y.z.cdn.example.com", "", true},
+		{"z.cdn.example.com", "", true},
+		{"w.x.y.z.cdn.example.com", "", false},
+		{"q.y.z.cdn.example.com", "", false},
+		{"other.cdn.example.com", "*.cdn.example.com", false},
+		{"s.alias.cdn.example.com", "*.alias.cdn.example.com", false},
+	}
+	for _, test := range tests {
+		var record = z.lookup(test.domain)
+		if record == nil && test.record != "" || record != nil && record.name != test.record {
+			t.Errorf("lookup(%s) = %v, want %q", test.domain, record, test.record)
+		}
+		if z.hasDescendant(test.domain) != test.descendant {
+			t.Errorf("hasDescendant(%s) = %v, want %v", test.domain, !test.descendant, test.descendant)
+		}
+	}
+	if target := z.lookup("www.cdn.example.com").cname; target != "cdn.example.com" {
+		t.Errorf("alias target %q, want the lowercased name without the root", target)
+	}
+	if target := z.lookup("s.alias.cdn.example.com").cname; target != "cdn.example.org" {
+		t.Errorf("wildcard alias target %q, want cdn.example.org", target)
+	}
+}
+
+// wildcards and aliases are answered like the names they match, and an empty non terminal
+// answers NODATA while a name below the wildcard's blocker is NXDOMAIN
+func TestWildcardAndAliasAnswers(t *testing.T) {
+	var zones = testZones(t)
+	var z = zones.zones[0]
+	for _, record := range []struct{ name, cname string }{{"*.alias", "cdn.example.org"}, {"img", "cdn.example.org"}} {
+		if err := z.addRecord(record.name, nil, record.cname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		rcode  uint8
+		target string // cname in the answer, empty for none
+	}{
+		{"s.alias.cdn.example.com", typeA, rcodeNoError, "cdn.example.org"},
+		{"deep.s.alias.cdn.example.com", typeAAAA, rcodeNoError, "cdn.example.org"},
+		{"img.cdn.example.com", typeA, rcodeNoError, "cdn.example.org"},
+		{"alias.cdn.example.com", typeA, rcodeNoError, ""},
+		{"x.img.cdn.example.com", typeA, rcodeNXDomain, ""},
+		{"b.cdn.example.com", typeAAAA, rcodeNoError, ""},
+	}
+	for _, test := range tests {
+		var body = handleQuery(testQuery(t, test.name, test.qtype, classIN, 0), net.ParseIP("8.8.8.8"), false, zones, &router{})
+		var response = &dnsPacket{}
+		if err := response.parseDNS(body); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response.rcode != test.rcode {
+			t.Errorf("%s: rcode %d, want %d", test.name, response.rcode, test.rcode)
+		}
+		if test.target == "" {
+			if len(response.answers) != 0 {
+				t.Errorf("%s: %d answers, want none", test.name, len(response.answers))
+			}
+			continue
+		}
+		if len(response.answers) != 1 || response.answers[0].rtype != typeCNAME {
+			t.Errorf("%s: answers %v, want a single CNAME", test.name, response.answers)
+			continue
+		}
+		var reader = &dnsReader{msg: body, off: len(body) - len(response.answers[0].rdata.(rawRdata))}
+		if target, err := reader.readName(); err != nil || byteArraysToDomain(target) != test.target {
+			t.Errorf("%s: alias to %q, %v, want %s", test.name, byteArraysToDomain(target), err, test.target)
+		}
+		if owner := byteArraysToDomain(response.answers[0].name); owner != test.name {
+			t.Errorf("%s: CNAME owned by %s", test.name, owner)
+		}
+	}
+}
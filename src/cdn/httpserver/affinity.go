@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cdn/protocol"
+)
+
+// how long to wait for a dns server to send the affinity ring before warming the cache with everything
+const ringWait = 10 * time.Second
+
+// header on requests one replica sends another to fill a miss, the receiving replica never passes them on
+const peerHeader = "X-Cdn-Peer"
+
+// how long a replica waits on a peer before going to the origin instead
+const peerTimeout = 2 * time.Second
+
+// the affinity ring the dns servers last sent, deciding which path prefixes this replica warms
+// and which replicas misses on the rest are filled from
+type ringState struct {
+	ring  *protocol.AffinityRing // nil until a dns server sends one, content isn't hashed until then
+	depth int                    // leading path segments paths are hashed by, 0 for the whole path
+	ready chan bool              // closed once the first ring arrives
+	mutex sync.RWMutex           // lock for ring
+}
+
+func newRingState(depth int) *ringState {
+	return &ringState{depth: depth, ready: make(chan bool)}
+}
+
+// set replaces the ring with the one a dns server sent
+func (state *ringState) set(ring protocol.AffinityRing) error {
+	if ring.Replicas < 1 {
+		return errors.New("Affinity ring must hash content to at least one replica")
+	} else if !containsHost(ring.Hosts, ring.Self) {
+		return errors.New("Affinity ring does not contain this replica " + ring.Self)
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.ring == nil {
+		close(state.ready)
+	}
+	state.ring = &ring
+	return nil
+}
+
+// wait blocks until the first ring arrives or timeout passes
+func (state *ringState) wait(timeout time.Duration) {
+	select {
+	case <-state.ready:
+	case <-time.After(timeout):
+	}
+}
+
+// owners returns the replicas the path's prefix is hashed to, highest first, nil without a ring
+func (state *ringState) owners(path string) []string {
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	if state.ring == nil {
+		return nil
+	}
+	return protocol.RendezvousOwners(pathPrefix(strings.ToLower(path), state.depth), state.ring.Hosts, state.ring.Replicas)
+}
+
+// owns returns whether this replica should cache the path, every path is owned without a ring
+func (state *ringState) owns(path string) bool {
+	var owners = state.owners(path)
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	return owners == nil || containsHost(owners, state.ring.Self)
+}
+
+// pathPrefix returns the first depth segments of path, or all of it for a depth of 0
+func pathPrefix(path string, depth int) string {
+	if depth < 1 {
+		return path
+	}
+	var segments = strings.SplitN(strings.TrimPrefix(path, "/"), "/", depth+1)
+	if len(segments) > depth {
+		segments = segments[:depth]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, candidate := range hosts {
+		if candidate == host {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchFromPeers asks the replicas owning the path for it in turn, so a miss on content
+// this replica doesn't specialize in is filled from a peer's cache rather than the origin
+// it returns nil without an error when the miss should go straight to the origin: the path is
+// this replica's own, or the request came from a peer and passing it on again could loop
+func (replica *replica) fetchFromPeers(req *http.Request, path string) (*http.Response, error) {
+	if req.Header.Get(peerHeader) != "" || replica.ring.owns(path) {
+		return nil, nil
+	}
+	var lastErr error
+	for _, owner := range replica.ring.owners(path) {
+		// the ring names replicas by the address and port they serve http on
+		peerReq, err := http.NewRequest(http.MethodGet, "http://"+owner+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		peerReq.Header.Set(peerHeader, "1")
+		resp, err := replica.peerClient.Do(peerReq)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
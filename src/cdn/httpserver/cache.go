@@ -118,7 +118,8 @@ func (cache *cache) getFromCache(path string) (*http.Response, error) {
 	return resp, nil
 }
 
-func (cache *cache) buildCache(origin, popularFileName string) {
+// buildCache warms the cache with the popular paths owns says this replica should hold
+func (cache *cache) buildCache(origin, popularFileName string, owns func(path string) bool) {
 	f, err := os.Open(popularFileName)
 	if errorCheck(err) {
 		return
@@ -131,7 +132,7 @@ func (cache *cache) buildCache(origin, popularFileName string) {
 		scanner := bufio.NewScanner(f)
 		for scanner.Scan() {
 			path := strings.Fields(scanner.Text())[0]
-			if strings.HasPrefix(path, "/wiki") {
+			if strings.HasPrefix(path, "/wiki") && owns(path) {
 				getPool <- path
 			}
 			totalCapacity := cache.diskCacheSize + cache.memCacheSize
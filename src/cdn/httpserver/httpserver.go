@@ -5,14 +5,30 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
+
+	"cdn/protocol"
 )
 
+// what the replica needs to answer the dns servers' control channels and what it reports over them
+type replica struct {
+	secret     []byte // shared with the dns servers
+	prober     *prober
+	channels   *controlChannels
+	passive    *passiveRTTs
+	stats      loadStats
+	ring       *ringState
+	peerClient *http.Client // fills misses from the replicas that own the content
+	registrar  *registrar   // keeps the replica registered with the dns servers, if it was given any
+}
+
 // errorCheck is a convenience method that will print to standard error if err is an Error
 func errorCheck(err error) bool {
 	if err != nil {
@@ -24,39 +40,65 @@ func errorCheck(err error) bool {
 
 // httpServer takes in the port and the url of the origin server
 // It initializes a tcp socket and spawns go routines to handle incoming connections
-func httpServer(port int, origin string, cache *cache, cdnAddr net.IP) {
+// if controlPort is set the dns servers' control channels are also accepted on a socket of their own
+// the first signal drains the replica and deregisters it before exiting, a second exits right away
+func httpServer(port int, controlPort int, origin string, cache *cache, replica *replica) {
 	var signals = make(chan os.Signal, 1)
 	var conns = make(chan *net.TCPConn, 1)
+	var failed = make(chan bool, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
-
-	go func() {
-		for {
-			connection, err := listener.AcceptTCP()
-			if errorCheck(err) {
-				close(signals)
-				return
-			}
-			conns <- connection
-		}
-	}()
-
-	client := &http.Client{}
 	if errorCheck(err) {
 		return
 	}
 	defer listener.Close()
+	go acceptConnections(listener, conns, failed)
+	if controlPort != 0 && controlPort != port {
+		controlListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: controlPort})
+		if errorCheck(err) {
+			return
+		}
+		defer controlListener.Close()
+		go acceptConnections(controlListener, conns, failed)
+	}
+	replica.registrar.start()
+
+	client := &http.Client{}
+	var shutdown chan bool // closed once the replica has drained and deregistered, nil until a signal
 	for {
 		select {
-		case connection, ok := <-conns:
-			if !ok {
+		case connection := <-conns:
+			go handleConnection(connection, origin, client, cache, replica)
+		case <-failed:
+			return
+		case <-shutdown:
+			return
+		case <-signals:
+			if shutdown != nil {
 				return
 			}
-			go handleConnection(connection, origin, client, cache, cdnAddr)
-		case <-signals:
-			listener.Close()
+			// keep serving while draining
+			shutdown = make(chan bool)
+			go func() {
+				replica.registrar.shutdown()
+				close(shutdown)
+			}()
+		}
+	}
+}
+
+// acceptConnections puts the connections accepted on listener on conns until it fails
+func acceptConnections(listener *net.TCPListener, conns chan *net.TCPConn, failed chan bool) {
+	for {
+		connection, err := listener.AcceptTCP()
+		if errorCheck(err) {
+			select {
+			case failed <- true:
+			default:
+			}
 			return
 		}
+		conns <- connection
 	}
 }
 
@@ -67,47 +109,74 @@ func handleConnection(
 	origin string,
 	client *http.Client,
 	cache *cache,
-	cdnAddr net.IP) {
+	replica *replica) {
 	defer connection.Close()
-	if cdnAddr.Equal(net.ParseIP(connection.LocalAddr().String())) {
-		pingServer := pingServer{connection}
+	reader := bufio.NewReader(connection)
+	if isControlConnection(reader) {
+		// the handshake proves the other end is the dns server
+		pingServer := pingServer{conn: protocol.NewConn(connection, reader), replica: replica}
 		pingServer.start()
 		return
 	}
-	req, err := http.ReadRequest(bufio.NewReader(connection))
+	req, err := http.ReadRequest(reader)
 	if errorCheck(err) {
 		return
 	}
 	err = nil
 	var resp *http.Response
 	path := strings.ToLower(req.RequestURI)
+	if path == protocol.HealthPath {
+		// the dns server's health checks are neither load nor clients to measure
+		healthResponse(req).Write(connection)
+		return
+	}
+	replica.stats.connections.Add(1)
+	defer replica.stats.connections.Add(-1)
+	// the kernel's rtt estimate is best once the response has been acked, so it is read last
+	defer replica.passive.observe(connection)
+	replica.stats.requests.Add(1)
+	var out = countingWriter{connection, &replica.stats}
 	if cache.containsPath(path) {
 		resp, err = cache.getFromCache(path)
 		if !errorCheck(err) {
-			resp.Write(connection)
+			replica.stats.hits.Add(1)
+			resp.Write(out)
 			errorCheck(err)
 			return
 		}
 		// If there's an error then we try to grab it from the origin
 	}
-	resp, err = client.Get(origin + path)
-	if errorCheck(err) {
-		return
+	resp, err = replica.fetchFromPeers(req, path)
+	if errorCheck(err) || resp == nil {
+		// the origin has everything, even when the replicas owning the path can't be reached
+		resp, err = client.Get(origin + path)
+		if errorCheck(err) {
+			return
+		}
 	}
-	err = resp.Write(connection)
+	err = resp.Write(out)
 	errorCheck(err)
 }
 
-// resolveCDNAddr gets the ip address of the cdn
-func resolveCDNAddr() (net.IP, error) {
-	ips, err := net.LookupIP("cs5700cdnproject.ccs.neu.edu")
-	if err != nil {
-		return nil, err
-	} else if len(ips) == 0 {
-		return nil, fmt.Errorf("No IPs returned")
-	} else {
-		return ips[0], nil
-	}
+// isControlConnection returns whether the connection is the dns server's control channel
+// rather than an http request, control frames start with a byte no http request starts with
+func isControlConnection(reader *bufio.Reader) bool {
+	first, err := reader.Peek(1)
+	return err == nil && protocol.IsStart(first[0])
+}
+
+// healthResponse tells the dns server's health checks this replica is able to serve
+func healthResponse(req *http.Request) *http.Response {
+	body := "ok\n"
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true}
 }
 
 func main() {
@@ -116,6 +185,18 @@ func main() {
 	// argument parsing, take in -p port and -n name
 	var port = flag.Int("p", -1, "Port for http server to bind on")
 	var origin = flag.String("o", "", "URL for the origin server")
+	var secretFile = flag.String("secret", "cdn.secret", "File holding the secret shared with the dns server")
+	var probeMethods = flag.String("probe", defaultProbeMethod, "Comma separated rtt probe methods to try in order, icmp, tcp:port or udp:port")
+	var probeCount = flag.Int("probe-count", 3, "Probes sent to a client per rtt measurement")
+	var probeTimeout = flag.Duration("probe-timeout", time.Second, "How long each rtt probe waits for its answer")
+	var controlPort = flag.Int("control-port", 0, "Port to also accept the dns server's control channel on, besides the http port")
+	var register = flag.String("register", "", "Comma separated host:port registration addresses of dns servers to register with")
+	var id = flag.String("id", "", "Id to register under, defaults to the hostname")
+	var advertise = flag.String("advertise", "", "Comma separated addresses to register, defaults to the address the dns server sees")
+	var region = flag.String("region", "", "Region to register in")
+	var capacity = flag.Int("capacity", 0, "Capacity to register with, relative to the other hosts, 0 for the dns server's default")
+	var drainTime = flag.Duration("drain", 30*time.Second, "How long to keep serving after a signal while registered dns servers stop handing this replica out")
+	var affinityDepth = flag.Int("affinity-depth", 0, "Leading path segments paths are hashed by when the dns server turns on affinity, 0 for the whole path")
 	flag.Parse()
 	// checking for valid arguments
 	if *port == -1 || *origin == "" {
@@ -136,19 +217,46 @@ func main() {
 	if !strings.HasSuffix(*origin, ":8080") {
 		*origin += ":8080"
 	}
+	secret, err := protocol.LoadSecret(*secretFile)
+	if errorCheck(err) {
+		return
+	}
+	prober, err := newProber(*probeMethods, *probeCount, *probeTimeout)
+	if errorCheck(err) {
+		return
+	}
+	if *id == "" {
+		*id, _ = os.Hostname()
+	}
+	var request = protocol.Registration{ID: *id, HTTPPort: *port, ControlPort: *controlPort, Capacity: *capacity, Region: *region}
+	for _, address := range strings.Split(*advertise, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			request.Addresses = append(request.Addresses, address)
+		}
+	}
+	registrar, err := newRegistrar(*register, request, secret, *drainTime)
+	if errorCheck(err) {
+		return
+	}
 	var bytesInMegabyte uint = 1000000
 	cache := &cache{}
 	cache.init(10*bytesInMegabyte, 6*bytesInMegabyte)
-	go cache.buildCache(*origin, "popular.txt")
-	var cdnAddr net.IP
-	var err error
-	for {
-		cdnAddr, err = resolveCDNAddr()
-		if !errorCheck(err) {
-			break
-		}
-	}
+	var replica = &replica{
+		secret:     secret,
+		prober:     prober,
+		channels:   newControlChannels(),
+		passive:    newPassiveRTTs(),
+		ring:       newRingState(*affinityDepth),
+		peerClient: &http.Client{Timeout: peerTimeout},
+		registrar:  registrar}
+	go func() {
+		// with affinity on only the paths this replica owns are warmed, so give the dns server a chance to connect
+		replica.ring.wait(ringWait)
+		cache.buildCache(*origin, "popular.txt", replica.ring.owns)
+	}()
+	go replica.passive.report(replica.channels)
+	go replica.stats.report(replica.channels)
 	fmt.Println(*port, *origin)
-	httpServer(*port, *origin, cache, cdnAddr)
+	httpServer(*port, *controlPort, *origin, cache, replica)
 	fmt.Println("Exiting...")
 }
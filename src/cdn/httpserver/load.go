@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"cdn/protocol"
+)
+
+// counts of what the http server has done, reported to the dns servers as rates
+type loadStats struct {
+	connections atomic.Int64 // http connections open now
+	requests    atomic.Int64 // requests for content, health checks aren't counted
+	hits        atomic.Int64 // requests answered from the cache
+	bytes       atomic.Int64 // response bytes written to clients
+}
+
+// counts the bytes written through it towards the stats
+type countingWriter struct {
+	writer io.Writer
+	stats  *loadStats
+}
+
+func (counter countingWriter) Write(p []byte) (int, error) {
+	n, err := counter.writer.Write(p)
+	counter.stats.bytes.Add(int64(n))
+	return n, err
+}
+
+// report sends the load over the last interval to every connected dns server, forever
+func (stats *loadStats) report(channels *controlChannels) {
+	var last = time.Now()
+	var requests, hits, bytes int64
+	for now := range time.Tick(protocol.LoadReportInterval) {
+		var seconds = now.Sub(last).Seconds()
+		var newRequests, newHits, newBytes = stats.requests.Load(), stats.hits.Load(), stats.bytes.Load()
+		var report = protocol.LoadReport{
+			Connections: stats.connections.Load(),
+			RPS:         float64(newRequests-requests) / seconds,
+			Bandwidth:   float64(newBytes-bytes) / seconds}
+		if newRequests > requests {
+			report.HitRatio = float64(newHits-hits) / float64(newRequests-requests)
+		}
+		channels.broadcast(protocol.MsgLoadReport, report)
+		last, requests, hits, bytes = now, newRequests, newHits, newBytes
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"cdn/protocol"
+)
+
+// how often the rtts seen on live connections are reported to the dns servers
+const passiveReportInterval = 10 * time.Second
+
+// bounds on a report, so a flood of clients can't grow it without limit or overflow a frame
+const (
+	maxPassivePrefixes   int = 65536 // prefixes tracked between reports, connections from new ones are dropped
+	maxPrefixesPerReport int = 256   // prefixes sent in one frame
+)
+
+// collects the rtts the kernel measured on client connections by client prefix
+type passiveRTTs struct {
+	prefixes map[string]*protocol.PassiveRTT // client prefixes to their rtts since the last report
+	mutex    sync.Mutex
+}
+
+// newPassiveRTTs creates an empty collector, call report to start sending what it collects
+func newPassiveRTTs() *passiveRTTs {
+	return &passiveRTTs{prefixes: make(map[string]*protocol.PassiveRTT)}
+}
+
+// observe adds the rtt of the client connection to its prefix
+func (passive *passiveRTTs) observe(connection *net.TCPConn) {
+	var addr, ok = connection.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	rtt, ok := connectionRTT(connection)
+	if !ok {
+		return
+	}
+	var ms = float64(rtt) / float64(time.Millisecond)
+	var prefix = protocol.ClientPrefix(addr.IP)
+	passive.mutex.Lock()
+	defer passive.mutex.Unlock()
+	if sample, in := passive.prefixes[prefix]; in {
+		sample.RTT += ms // summed until the report averages it
+		sample.Min = min(sample.Min, ms)
+		sample.Samples++
+	} else if len(passive.prefixes) < maxPassivePrefixes {
+		passive.prefixes[prefix] = &protocol.PassiveRTT{Prefix: prefix, RTT: ms, Min: ms, Samples: 1}
+	}
+}
+
+// report sends the rtts collected since the last report to every connected dns server, forever
+// rtts collected while no dns server is connected are dropped
+func (passive *passiveRTTs) report(channels *controlChannels) {
+	for range time.Tick(passiveReportInterval) {
+		passive.mutex.Lock()
+		var prefixes = make([]protocol.PassiveRTT, 0, len(passive.prefixes))
+		for _, sample := range passive.prefixes {
+			sample.RTT /= float64(sample.Samples)
+			prefixes = append(prefixes, *sample)
+		}
+		passive.prefixes = make(map[string]*protocol.PassiveRTT)
+		passive.mutex.Unlock()
+
+		for len(prefixes) > 0 {
+			var chunk = prefixes[:min(len(prefixes), maxPrefixesPerReport)]
+			prefixes = prefixes[len(chunk):]
+			channels.broadcast(protocol.MsgPassiveRTT, protocol.PassiveReport{Prefixes: chunk})
+		}
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// TCP_INFO and the offset of tcpi_rtt, the smoothed rtt in microseconds, in struct tcp_info on linux
+const (
+	tcpInfo          = 0xb
+	tcpInfoRTTOffset = 68
+	tcpInfoLength    = 104
+)
+
+// connectionRTT returns the kernel's smoothed rtt for the connection
+func connectionRTT(connection *net.TCPConn) (time.Duration, bool) {
+	raw, err := connection.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var info = make([]byte, tcpInfoLength)
+	var length = uint32(len(info))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, tcpInfo,
+			uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&length)), 0)
+	})
+	if err != nil || errno != 0 || length < tcpInfoRTTOffset+4 {
+		return 0, false
+	}
+	var rtt = binary.NativeEndian.Uint32(info[tcpInfoRTTOffset:])
+	return time.Duration(rtt) * time.Microsecond, rtt > 0
+}
@@ -0,0 +1,13 @@
+//go:build !(linux && (amd64 || arm64))
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// connectionRTT reports no rtt, the kernel's estimate is only read through TCP_INFO on 64 bit linux
+func connectionRTT(connection *net.TCPConn) (time.Duration, bool) {
+	return 0, false
+}
@@ -1,53 +1,104 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
-	"strings"
+	"sync"
+
+	"cdn/protocol"
 )
 
+// most pings a replica runs at once for the dns server, further requests wait their turn
+const maxConcurrentPings int = 32
+
 type pingServer struct {
-	connection *net.TCPConn
+	conn    *protocol.Conn
+	replica *replica  // reports are sent over the channel once it is authenticated
+	slots   chan bool // one entry per ping in flight
+}
+
+// the authenticated control channels of every dns server connected to this replica
+type controlChannels struct {
+	conns map[*protocol.Conn]bool
+	mutex sync.Mutex
+}
+
+func newControlChannels() *controlChannels {
+	return &controlChannels{conns: make(map[*protocol.Conn]bool)}
+}
+
+func (channels *controlChannels) add(conn *protocol.Conn) {
+	channels.mutex.Lock()
+	channels.conns[conn] = true
+	channels.mutex.Unlock()
+}
+
+func (channels *controlChannels) remove(conn *protocol.Conn) {
+	channels.mutex.Lock()
+	delete(channels.conns, conn)
+	channels.mutex.Unlock()
+}
+
+// broadcast sends the message to every connected dns server, channels that fail are closed
+// and reconnected by their dns server
+func (channels *controlChannels) broadcast(typ byte, message interface{}) {
+	channels.mutex.Lock()
+	var conns = make([]*protocol.Conn, 0, len(channels.conns))
+	for conn := range channels.conns {
+		conns = append(conns, conn)
+	}
+	channels.mutex.Unlock()
+	for _, conn := range conns {
+		if errorCheck(conn.WriteMessage(typ, message)) {
+			conn.Close()
+		}
+	}
 }
 
 func (pingServer *pingServer) start() {
-	connReader := bufio.NewReader(pingServer.connection)
+	if errorCheck(pingServer.conn.ReplicaHandshake(pingServer.replica.secret)) {
+		return
+	}
+	pingServer.replica.channels.add(pingServer.conn)
+	defer pingServer.replica.channels.remove(pingServer.conn)
+	pingServer.slots = make(chan bool, maxConcurrentPings)
 	for {
-		line, err := connReader.ReadString('\n')
+		typ, payload, err := pingServer.conn.ReadFrame()
 		if errorCheck(err) {
 			break
 		}
-		ip := net.ParseIP(strings.Replace(line, "\n", "", -1))
-		if ip == nil {
-			fmt.Fprintln(os.Stderr, "Could not parse ip address, skipping")
-			continue
-		}
-		ping := exec.Command("ping", ip.String(), "-c", "3", "-l", "3")
-
-		out, err := ping.Output()
-		if errorCheck(err) {
-			continue
-		}
-		split0 := bytes.Split(out, []byte("\n"))
-		if len(split0) < 2 {
-			fmt.Fprintln(os.Stderr, "Could not parse ping lines: ", string(out))
-			continue
-		}
-		split1 := bytes.Fields(split0[len(split0)-2])
-		if len(split1) != 7 {
-			fmt.Fprintln(os.Stderr, "Could not parse ping output: ", string(out))
+		if typ == protocol.MsgAffinity {
+			var ring protocol.AffinityRing
+			if !errorCheck(json.Unmarshal(payload, &ring)) {
+				errorCheck(pingServer.replica.ring.set(ring))
+			}
 			continue
 		}
-		split2 := bytes.Split(split1[3], []byte("/"))
-		if len(split2) != 4 {
-			fmt.Fprintln(os.Stderr, "Could not parse ping average: ", string(out))
+		var request protocol.PingRequest
+		if typ != protocol.MsgPingRequest || errorCheck(json.Unmarshal(payload, &request)) {
+			// message types added by newer dns servers are skipped
 			continue
 		}
-		avg := split2[1]
-		pingServer.connection.Write(append([]byte(ip.String()+" "), append(avg, '\n')...))
+		pingServer.slots <- true
+		go pingServer.ping(request)
+	}
+}
+
+// ping measures the rtt to the requested client and sends the result back under the request's id
+// a client that can't be reached is still answered, with all of its probes lost
+func (pingServer *pingServer) ping(request protocol.PingRequest) {
+	defer func() { <-pingServer.slots }()
+	var result = protocol.PingResult{ID: request.ID, Client: request.Client, Loss: 1.0}
+	if ip := net.ParseIP(request.Client); ip == nil {
+		fmt.Fprintln(os.Stderr, "Could not parse ip address: ", request.Client)
+	} else {
+		pingServer.replica.prober.measure(ip, &result)
+	}
+	err := pingServer.conn.WriteMessage(protocol.MsgPingResult, result)
+	if errorCheck(err) {
+		// the dns server reconnects on its own, drop this connection
+		pingServer.conn.Close()
 	}
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cdn/protocol"
+)
+
+// icmp echo message types
+const (
+	icmpEchoRequest    byte = 8
+	icmpEchoReply      byte = 0
+	icmpv6EchoRequest  byte = 128
+	icmpv6EchoReply    byte = 129
+	icmpHeaderLength   int  = 8
+	probeTokenLength   int  = 8
+	defaultProbeMethod      = "icmp,tcp:80,udp:33434"
+)
+
+// ip protocol numbers of icmp and icmpv6, the syscall package only names them on some platforms
+const (
+	protocolICMP   int = 1
+	protocolICMPv6 int = 58
+)
+
+// returned by a probe that got no answer in time, as opposed to a method that can't be used at all
+var errProbeLost = errors.New("Probe timed out")
+
+// a way of timing one round trip to an ip
+type probeMethod interface {
+	probe(ip net.IP, seq int, timeout time.Duration) (time.Duration, error)
+	name() string
+}
+
+// icmp echo, through an unprivileged ping socket where the kernel allows it and a raw socket otherwise
+type icmpProbe struct{}
+
+// the time to complete a tcp handshake, or to be refused, on a port
+type tcpProbe struct {
+	port int
+}
+
+// the time for a datagram to a port to draw a reply or an icmp port unreachable
+type udpProbe struct {
+	port int
+}
+
+// measures rtts to clients with a list of methods, falling back to the next when one gets no answers
+type prober struct {
+	methods []probeMethod
+	count   int           // probes sent per measurement, all at once
+	timeout time.Duration // how long each probe waits for its answer
+}
+
+// newProber builds a prober from a comma separated list of icmp, tcp[:port] and udp[:port] methods
+func newProber(spec string, count int, timeout time.Duration) (*prober, error) {
+	if count < 1 {
+		return nil, errors.New("At least one probe must be sent per measurement")
+	}
+	var p = &prober{count: count, timeout: timeout}
+	for _, entry := range strings.Split(spec, ",") {
+		var fields = strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		var port = 0
+		if len(fields) == 2 {
+			var err error
+			if port, err = strconv.Atoi(fields[1]); err != nil || port < 1 || port > 65535 {
+				return nil, errors.New("Invalid port in probe method " + entry)
+			}
+		}
+		switch {
+		case fields[0] == "icmp" && len(fields) == 1:
+			p.methods = append(p.methods, icmpProbe{})
+		case fields[0] == "tcp" && port != 0:
+			p.methods = append(p.methods, tcpProbe{port})
+		case fields[0] == "udp" && port != 0:
+			p.methods = append(p.methods, udpProbe{port})
+		default:
+			return nil, errors.New("Unknown probe method " + entry + ", use icmp, tcp:port or udp:port")
+		}
+	}
+	return p, nil
+}
+
+// measure fills in the result's rtt statistics and loss for ip
+// the first method that gets any answer is used, a client that answers nothing is reported fully lost
+func (p *prober) measure(ip net.IP, result *protocol.PingResult) {
+	result.Loss = 1.0
+	for _, method := range p.methods {
+		var rtts, err = p.run(method, ip)
+		if len(rtts) == 0 {
+			if err != errProbeLost {
+				errorCheck(errors.New(method.name() + " probe of " + ip.String() + " failed: " + err.Error()))
+			}
+			continue
+		}
+		summarize(rtts, p.count, result)
+		return
+	}
+}
+
+// run sends every probe of a measurement at once and returns the rtts of the ones answered in seq order
+// if none were answered the error of the last probe says whether they were lost or couldn't be sent
+func (p *prober) run(method probeMethod, ip net.IP) ([]time.Duration, error) {
+	var rtts = make([]time.Duration, p.count)
+	var errs = make([]error, p.count)
+	var wg sync.WaitGroup
+	for seq := 0; seq < p.count; seq++ {
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			rtts[seq], errs[seq] = method.probe(ip, seq, p.timeout)
+		}(seq)
+	}
+	wg.Wait()
+	var answered = make([]time.Duration, 0, p.count)
+	var lastErr error
+	for seq := range rtts {
+		if errs[seq] == nil {
+			answered = append(answered, rtts[seq])
+		} else {
+			lastErr = errs[seq]
+		}
+	}
+	return answered, lastErr
+}
+
+// summarize computes min, avg, max, jitter and loss in milliseconds from the answered probes of sent
+// jitter is the mean difference between consecutive rtts
+func summarize(rtts []time.Duration, sent int, result *protocol.PingResult) {
+	var ms = make([]float64, len(rtts))
+	var sum, jitter = 0.0, 0.0
+	for i, rtt := range rtts {
+		ms[i] = float64(rtt) / float64(time.Millisecond)
+		sum += ms[i]
+		if i > 0 {
+			jitter += math.Abs(ms[i] - ms[i-1])
+		}
+	}
+	if len(ms) > 1 {
+		jitter /= float64(len(ms) - 1)
+	}
+	result.RTT = sum / float64(len(ms))
+	result.Jitter = jitter
+	sort.Float64s(ms)
+	result.Min, result.Max = ms[0], ms[len(ms)-1]
+	result.Loss = float64(sent-len(rtts)) / float64(sent)
+}
+
+func (icmpProbe) name() string {
+	return "icmp"
+}
+
+// probe sends one echo request and waits for the reply carrying its sequence number and token
+// ping sockets rewrite the echo id, so replies are matched on the random token in the data instead
+func (icmpProbe) probe(ip net.IP, seq int, timeout time.Duration) (time.Duration, error) {
+	var ipv6 = ip.To4() == nil
+	conn, err := listenICMP(ipv6)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if _, datagram := conn.(*net.UDPConn); datagram {
+		dst = &net.UDPAddr{IP: ip}
+	}
+	var token = make([]byte, probeTokenLength)
+	if _, err = rand.Read(token); err != nil {
+		return 0, err
+	}
+	var request, reply = icmpEchoRequest, icmpEchoReply
+	if ipv6 {
+		request, reply = icmpv6EchoRequest, icmpv6EchoReply
+	}
+	var msg = []byte{request, 0, 0, 0, 0, 0, byte(seq >> 8), byte(seq)}
+	binary.BigEndian.PutUint16(msg[4:], uint16(os.Getpid()))
+	msg = append(msg, token...)
+	if !ipv6 {
+		// the kernel fills in the icmpv6 checksum since it covers the ipv6 pseudo header
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+
+	var start = time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err = conn.WriteTo(msg, dst); err != nil {
+		return 0, err
+	}
+	var buf = make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return 0, errProbeLost
+			}
+			return 0, err
+		}
+		var answer = buf[:n]
+		if len(answer) >= icmpHeaderLength+probeTokenLength && answer[0] == reply &&
+			int(binary.BigEndian.Uint16(answer[6:])) == seq&0xFFFF &&
+			string(answer[icmpHeaderLength:icmpHeaderLength+probeTokenLength]) == string(token) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// listenICMP opens an unprivileged ping socket, allowed on linux by net.ipv4.ping_group_range,
+// falling back to a raw socket which needs root or CAP_NET_RAW
+func listenICMP(ipv6 bool) (net.PacketConn, error) {
+	var family, proto, network = syscall.AF_INET, protocolICMP, "ip4:icmp"
+	if ipv6 {
+		family, proto, network = syscall.AF_INET6, protocolICMPv6, "ip6:ipv6-icmp"
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err == nil {
+		var file = os.NewFile(uintptr(fd), "icmp")
+		defer file.Close()
+		if conn, err := net.FilePacketConn(file); err == nil {
+			return conn, nil
+		}
+	}
+	return net.ListenPacket(network, "")
+}
+
+// icmpChecksum is the internet checksum of an icmp message with its checksum field zeroed
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func (method tcpProbe) name() string {
+	return "tcp:" + strconv.Itoa(method.port)
+}
+
+// probe times a tcp connect, a refused connection still took a round trip to the client
+func (method tcpProbe) probe(ip net.IP, seq int, timeout time.Duration) (time.Duration, error) {
+	var start = time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(method.port)), timeout)
+	var rtt = time.Since(start)
+	if err == nil {
+		conn.Close()
+		return rtt, nil
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		return rtt, nil
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return 0, errProbeLost
+	}
+	return 0, err
+}
+
+func (method udpProbe) name() string {
+	return "udp:" + strconv.Itoa(method.port)
+}
+
+// probe times a datagram to a port that is most likely closed, the icmp port unreachable
+// the client sends back shows up as a refused read on the connected socket
+func (method udpProbe) probe(ip net.IP, seq int, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: method.port})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var start = time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err = conn.Write([]byte{byte(seq)}); err != nil {
+		return 0, err
+	}
+	_, err = conn.Read(make([]byte, 1500))
+	var rtt = time.Since(start)
+	if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+		return rtt, nil
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return 0, errProbeLost
+	}
+	return 0, err
+}
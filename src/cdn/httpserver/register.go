@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cdn/protocol"
+)
+
+// how long a write to a dns server may block before the registration is given up on and retried
+const registerWriteTimeout = 2 * time.Second
+
+// keeps the replica registered with each dns server it was given, so it joins their hosts on its own
+// on shutdown the replica drains first, so the dns servers stop handing it out while its clients
+// finish, and then deregisters
+type registrar struct {
+	servers   []string // registration addresses of the dns servers
+	request   protocol.Registration
+	secret    []byte
+	drainTime time.Duration // how long the replica drains before it deregisters
+	draining  atomic.Bool
+	wake      []chan bool // one per server, wakes its registration to send a heartbeat right away
+	stop      chan bool   // closed to deregister from every server
+	wg        sync.WaitGroup
+}
+
+// newRegistrar parses the comma separated dns server addresses, an empty list registers nowhere
+func newRegistrar(servers string, request protocol.Registration, secret []byte, drainTime time.Duration) (*registrar, error) {
+	var registrar = &registrar{request: request, secret: secret, drainTime: drainTime, stop: make(chan bool)}
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		} else if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, errors.New("Bad dns server registration address " + server + ": " + err.Error())
+		}
+		registrar.servers = append(registrar.servers, server)
+		registrar.wake = append(registrar.wake, make(chan bool, 1))
+	}
+	return registrar, nil
+}
+
+// start registers with every dns server in the background
+func (registrar *registrar) start() {
+	for i, server := range registrar.servers {
+		registrar.wg.Add(1)
+		go registrar.run(server, registrar.wake[i])
+	}
+}
+
+// run keeps the replica registered with the dns server until stop is closed, reconnecting with
+// exponential backoff whenever the registration can't be made or drops
+func (registrar *registrar) run(server string, wake chan bool) {
+	defer registrar.wg.Done()
+	var backoff protocol.Backoff
+	for {
+		conn, err := registrar.register(server)
+		if err == nil {
+			backoff.Reset()
+			err = registrar.heartbeats(conn, wake)
+			conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		errorCheck(err)
+		if !backoff.Wait(registrar.stop) {
+			return
+		}
+	}
+}
+
+// register dials the dns server, runs the handshake and sends the registration
+func (registrar *registrar) register(server string) (*protocol.Conn, error) {
+	conn, err := net.DialTimeout("tcp", server, protocol.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var pc = protocol.NewConn(conn, nil)
+	if err = pc.ReplicaHandshake(registrar.secret); err != nil {
+		conn.Close()
+		return nil, errors.New("Handshake with " + server + " failed: " + err.Error())
+	}
+	var request = registrar.request
+	request.Draining = registrar.draining.Load()
+	var reply protocol.Registered
+	conn.SetDeadline(time.Now().Add(protocol.HandshakeTimeout))
+	if err = pc.WriteMessage(protocol.MsgRegister, request); err == nil {
+		err = pc.ReadMessage(protocol.MsgRegistered, &reply)
+	}
+	conn.SetDeadline(time.Time{})
+	if err == nil && reply.Error != "" {
+		err = errors.New("Dns server " + server + " rejected the registration: " + reply.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fmt.Println("Registered with dns server", server)
+	return pc, nil
+}
+
+// heartbeats keeps the registration on conn alive until stop is closed, when it deregisters
+// it returns an error if the registration is lost first
+func (registrar *registrar) heartbeats(conn *protocol.Conn, wake chan bool) error {
+	var ticker = time.NewTicker(protocol.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-registrar.stop:
+			conn.SetWriteDeadline(time.Now().Add(registerWriteTimeout))
+			return conn.WriteMessage(protocol.MsgDeregister, struct{}{})
+		case <-ticker.C:
+		case <-wake:
+		}
+		conn.SetWriteDeadline(time.Now().Add(registerWriteTimeout))
+		if err := conn.WriteMessage(protocol.MsgHeartbeat, protocol.Heartbeat{Draining: registrar.draining.Load()}); err != nil {
+			return err
+		}
+	}
+}
+
+// drain asks the dns servers to stop handing this replica out
+func (registrar *registrar) drain() {
+	registrar.draining.Store(true)
+	for _, wake := range registrar.wake {
+		select {
+		case wake <- true:
+		default:
+		}
+	}
+}
+
+// deregister leaves every dns server's hosts, waiting up to timeout for them to be told
+func (registrar *registrar) deregister(timeout time.Duration) {
+	close(registrar.stop)
+	var done = make(chan bool)
+	go func() {
+		registrar.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// shutdown drains for the drain time, so clients holding this replica's address from earlier answers
+// can finish, and then deregisters, replicas that aren't registered anywhere shut down right away
+func (registrar *registrar) shutdown() {
+	if len(registrar.servers) == 0 {
+		return
+	}
+	fmt.Println("Draining for", registrar.drainTime)
+	registrar.drain()
+	time.Sleep(registrar.drainTime)
+	registrar.deregister(registerWriteTimeout)
+}
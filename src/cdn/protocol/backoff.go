@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"math/rand"
+	"time"
+)
+
+// bounds on how long to wait between attempts to reach the other server
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// the wait between attempts to reach the other server, doubling after every failed attempt,
+// the zero value starts from the shortest wait
+type Backoff struct {
+	next time.Duration
+}
+
+// Wait blocks for the next wait, or until stop is closed, and returns whether it wasn't stopped
+// the wait is jittered so a restarted server isn't hit by every retry at once
+func (b *Backoff) Wait(stop <-chan bool) bool {
+	var wait = max(b.next, minBackoff)
+	select {
+	case <-time.After(wait/2 + time.Duration(rand.Int63n(int64(wait/2)))):
+	case <-stop:
+		return false
+	}
+	b.next = min(2*wait, maxBackoff)
+	return true
+}
+
+// Reset goes back to the shortest wait once the other server was reached
+func (b *Backoff) Reset() {
+	b.next = 0
+}
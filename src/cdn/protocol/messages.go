@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// how often replicas report their load, reports that are several intervals old are ignored
+const LoadReportInterval = 5 * time.Second
+
+// how often registered replicas send heartbeats, a registration that misses a few is dropped
+const (
+	HeartbeatInterval  = 5 * time.Second
+	RegistrationExpiry = 3 * HeartbeatInterval
+)
+
+// path on every http server that answers 200 while the replica is able to serve, the dns server health checks it
+const HealthPath string = "/_cdn/health"
+
+// prefix lengths clients are grouped by in passive rtt reports
+const (
+	passivePrefix4 int = 24
+	passivePrefix6 int = 48
+)
+
+// asks a replica to measure its rtt to a client
+type PingRequest struct {
+	ID     uint64 `json:"id"`
+	Client string `json:"client"`
+}
+
+// a replica's measurement of a client, anything the replica couldn't measure is left out
+type PingResult struct {
+	ID     uint64  `json:"id"`
+	Client string  `json:"client"`
+	RTT    float64 `json:"rtt_ms"` // average round trip time
+	Min    float64 `json:"min_ms,omitempty"`
+	Max    float64 `json:"max_ms,omitempty"`
+	Jitter float64 `json:"jitter_ms,omitempty"`
+	Loss   float64 `json:"loss,omitempty"` // fraction of probes lost, 1 if the client couldn't be reached
+}
+
+// the rtts a replica's kernel measured on client connections since its last report
+type PassiveReport struct {
+	Prefixes []PassiveRTT `json:"prefixes"`
+}
+
+// the smoothed rtts of the connections from one client prefix
+type PassiveRTT struct {
+	Prefix  string  `json:"prefix"` // cidr, as given by ClientPrefix
+	RTT     float64 `json:"rtt_ms"` // average over the connections
+	Min     float64 `json:"min_ms"`
+	Samples int     `json:"samples"` // connections measured
+}
+
+// a replica's utilization over the last report interval
+type LoadReport struct {
+	Connections int64   `json:"connections"`   // http connections open at the time of the report
+	RPS         float64 `json:"rps"`           // http requests per second
+	Bandwidth   float64 `json:"bytes_per_sec"` // response bytes sent per second
+	HitRatio    float64 `json:"hit_ratio"`     // fraction of requests answered from the cache
+}
+
+// a replica announcing itself to a dns server, the dns server then opens the control channel to it
+type Registration struct {
+	ID          string   `json:"id"`
+	Addresses   []string `json:"addresses,omitempty"` // defaults to the address the registration came from
+	HTTPPort    int      `json:"http_port"`
+	ControlPort int      `json:"control_port,omitempty"` // defaults to the http port
+	Capacity    int      `json:"capacity,omitempty"`
+	Region      string   `json:"region,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Draining    bool     `json:"draining,omitempty"`
+}
+
+// the dns server's answer to a registration, the registration was rejected if error is set
+type Registered struct {
+	Error string `json:"error,omitempty"`
+}
+
+// sent by a registered replica every heartbeat interval, and right away when it starts draining
+type Heartbeat struct {
+	Draining bool `json:"draining,omitempty"` // the replica is finishing its clients and wants no new ones
+}
+
+// the replicas content is spread across, the receiving replica and the hosts nearest to it, each name
+// or path prefix belongs to the Replicas hosts with the highest rendezvous hash for it
+type AffinityRing struct {
+	Hosts    []string `json:"hosts"`
+	Replicas int      `json:"replicas"`
+	Self     string   `json:"self"` // the receiving replica's own entry in hosts
+}
+
+// ClientPrefix returns the cidr of the /24 or /48 the client ip is in, which passive rtts are keyed by
+func ClientPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(passivePrefix4, 32)), Mask: net.CIDRMask(passivePrefix4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(passivePrefix6, 128)), Mask: net.CIDRMask(passivePrefix6, 128)}).String()
+}
@@ -0,0 +1,273 @@
+// package protocol is the control protocol between the dns server and the http server replicas,
+// along with the rest of what both servers have to agree on
+package protocol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every frame is a magic byte, a version byte, a message type byte, a 4 byte payload length and
+// a json payload, so new fields can be added to messages without breaking older peers
+// the dns server and the replica prove to each other that they hold the shared secret with hmacs
+// over fresh nonces from both sides, and every frame after that ends with an hmac of the frame and
+// its sequence number under a per direction key derived from those nonces, so frames can't be
+// forged, replayed or reordered by anyone without the secret
+const (
+	protocolMagic   byte = 0xCD // not printable, so a control connection can't be mistaken for http
+	protocolVersion byte = 1
+)
+
+const (
+	frameHeaderLength int = 7
+	maxFrameLength    int = 64 * 1024
+	nonceLength       int = 32
+	minSecretLength   int = 16
+)
+
+// how long the peers have to finish the handshake before the connection is dropped
+const HandshakeTimeout = 5 * time.Second
+
+// message types
+const (
+	msgHello       byte = 1  // dns server to replica, its nonce
+	msgChallenge   byte = 2  // replica to dns server, its nonce and its proof
+	msgAuth        byte = 3  // dns server to replica, its proof
+	MsgPingRequest byte = 4  // dns server to replica
+	MsgPingResult  byte = 5  // replica to dns server
+	MsgPassiveRTT  byte = 6  // replica to dns server, rtts seen on live connections
+	MsgLoadReport  byte = 7  // replica to dns server, how busy it is
+	MsgAffinity    byte = 8  // dns server to replica, the ring content is hashed across
+	MsgRegister    byte = 9  // replica to dns server, on a connection the replica opened to join the hosts
+	MsgRegistered  byte = 10 // dns server to replica, whether the registration was accepted
+	MsgHeartbeat   byte = 11 // replica to dns server, keeps the registration alive
+	MsgDeregister  byte = 12 // replica to dns server, it is leaving the hosts
+)
+
+// labels that keep the hmacs for each purpose and direction apart
+const (
+	labelReplicaProof    string = "cdn replica proof"
+	labelControllerProof string = "cdn controller proof"
+	labelReplicaKey      string = "cdn replica key"
+	labelControllerKey   string = "cdn controller key"
+)
+
+// the payload of the handshake messages
+type handshakeMessage struct {
+	Nonce []byte `json:"nonce,omitempty"`
+	MAC   []byte `json:"mac,omitempty"`
+}
+
+// a connection speaking the control protocol
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	sendKey []byte // nil until the handshake is done
+	recvKey []byte
+	sendSeq uint64
+	recvSeq uint64
+	mutex   sync.Mutex // lock for writing frames and sendSeq
+}
+
+// LoadSecret reads the shared secret from path, surrounding whitespace is ignored
+func LoadSecret(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var secret = []byte(strings.TrimSpace(string(contents)))
+	if len(secret) < minSecretLength {
+		return nil, errors.New("Shared secret in " + path + " must be at least 16 bytes")
+	}
+	return secret, nil
+}
+
+// NewConn wraps conn, reader may already hold bytes read from it
+func NewConn(conn net.Conn, reader *bufio.Reader) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{conn: conn, reader: reader}
+}
+
+// IsStart returns whether the first byte of a connection starts a control protocol frame
+func IsStart(first byte) bool {
+	return first == protocolMagic
+}
+
+// WriteMessage sends message as a frame of the given type, safe to call from several threads
+func (pc *Conn) WriteMessage(typ byte, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	} else if len(payload) > maxFrameLength {
+		return errors.New("Control message is too long")
+	}
+	var frame = []byte{protocolMagic, protocolVersion, typ}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.sendKey != nil {
+		frame = append(frame, frameMAC(pc.sendKey, pc.sendSeq, frame)...)
+		pc.sendSeq++
+	}
+	_, err = pc.conn.Write(frame)
+	return err
+}
+
+// ReadFrame reads the next frame, checking its hmac once the handshake is done
+// it is not safe to call from several threads
+func (pc *Conn) ReadFrame() (byte, []byte, error) {
+	var header = make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(pc.reader, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != protocolMagic {
+		return 0, nil, errors.New("Control frame does not start with the protocol magic")
+	} else if header[1] != protocolVersion {
+		return 0, nil, errors.New("Unsupported control protocol version " + strconv.Itoa(int(header[1])))
+	}
+	var length = int(binary.BigEndian.Uint32(header[3:]))
+	if length > maxFrameLength {
+		return 0, nil, errors.New("Control frame is too long")
+	}
+	var frame = make([]byte, frameHeaderLength+length)
+	copy(frame, header)
+	if _, err := io.ReadFull(pc.reader, frame[frameHeaderLength:]); err != nil {
+		return 0, nil, err
+	}
+	if pc.recvKey != nil {
+		var mac = make([]byte, sha256.Size)
+		if _, err := io.ReadFull(pc.reader, mac); err != nil {
+			return 0, nil, err
+		}
+		if !hmac.Equal(mac, frameMAC(pc.recvKey, pc.recvSeq, frame)) {
+			return 0, nil, errors.New("Control frame failed authentication")
+		}
+		pc.recvSeq++
+	}
+	return header[2], frame[frameHeaderLength:], nil
+}
+
+// ReadMessage reads the next frame into message, failing if it isn't of the expected type
+func (pc *Conn) ReadMessage(typ byte, message interface{}) error {
+	frameType, payload, err := pc.ReadFrame()
+	if err != nil {
+		return err
+	} else if frameType != typ {
+		return errors.New("Unexpected control message type " + strconv.Itoa(int(frameType)))
+	}
+	return json.Unmarshal(payload, message)
+}
+
+// ControllerHandshake authenticates the connection from the dns server's side
+func (pc *Conn) ControllerHandshake(secret []byte) error {
+	pc.conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer pc.conn.SetDeadline(time.Time{})
+	var ours = make([]byte, nonceLength)
+	if _, err := rand.Read(ours); err != nil {
+		return err
+	}
+	if err := pc.WriteMessage(msgHello, handshakeMessage{Nonce: ours}); err != nil {
+		return err
+	}
+	var challenge handshakeMessage
+	if err := pc.ReadMessage(msgChallenge, &challenge); err != nil {
+		return err
+	} else if len(challenge.Nonce) != nonceLength {
+		return errors.New("Replica sent a bad nonce")
+	} else if !hmac.Equal(challenge.MAC, handshakeMAC(secret, labelReplicaProof, ours, challenge.Nonce)) {
+		return errors.New("Replica does not know the shared secret")
+	}
+	var proof = handshakeMAC(secret, labelControllerProof, ours, challenge.Nonce)
+	if err := pc.WriteMessage(msgAuth, handshakeMessage{MAC: proof}); err != nil {
+		return err
+	}
+	pc.sendKey = handshakeMAC(secret, labelControllerKey, ours, challenge.Nonce)
+	pc.recvKey = handshakeMAC(secret, labelReplicaKey, ours, challenge.Nonce)
+	return nil
+}
+
+// ReplicaHandshake authenticates the connection from the http server's side
+func (pc *Conn) ReplicaHandshake(secret []byte) error {
+	pc.conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer pc.conn.SetDeadline(time.Time{})
+	var hello handshakeMessage
+	if err := pc.ReadMessage(msgHello, &hello); err != nil {
+		return err
+	} else if len(hello.Nonce) != nonceLength {
+		return errors.New("Controller sent a bad nonce")
+	}
+	var ours = make([]byte, nonceLength)
+	if _, err := rand.Read(ours); err != nil {
+		return err
+	}
+	var proof = handshakeMAC(secret, labelReplicaProof, hello.Nonce, ours)
+	if err := pc.WriteMessage(msgChallenge, handshakeMessage{Nonce: ours, MAC: proof}); err != nil {
+		return err
+	}
+	var auth handshakeMessage
+	if err := pc.ReadMessage(msgAuth, &auth); err != nil {
+		return err
+	} else if !hmac.Equal(auth.MAC, handshakeMAC(secret, labelControllerProof, hello.Nonce, ours)) {
+		return errors.New("Controller does not know the shared secret")
+	}
+	pc.sendKey = handshakeMAC(secret, labelReplicaKey, hello.Nonce, ours)
+	pc.recvKey = handshakeMAC(secret, labelControllerKey, hello.Nonce, ours)
+	return nil
+}
+
+// handshakeMAC is the hmac of the label and the controller's and replica's nonces under the secret
+func handshakeMAC(secret []byte, label string, controllerNonce, replicaNonce []byte) []byte {
+	var mac = hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(controllerNonce)
+	mac.Write(replicaNonce)
+	return mac.Sum(nil)
+}
+
+// frameMAC is the hmac of a frame and its sequence number under a session key
+func frameMAC(key []byte, seq uint64, frame []byte) []byte {
+	var mac = hmac.New(sha256.New, key)
+	mac.Write(binary.BigEndian.AppendUint64(nil, seq))
+	mac.Write(frame)
+	return mac.Sum(nil)
+}
+
+// RemoteAddr returns the address of the other end
+func (pc *Conn) RemoteAddr() net.Addr {
+	return pc.conn.RemoteAddr()
+}
+
+// SetReadDeadline bounds how long reads may block, the zero time removes the bound
+func (pc *Conn) SetReadDeadline(t time.Time) error {
+	return pc.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline bounds how long writes may block, the zero time removes the bound
+func (pc *Conn) SetWriteDeadline(t time.Time) error {
+	return pc.conn.SetWriteDeadline(t)
+}
+
+// SetDeadline bounds how long reads and writes may block, the zero time removes the bound
+func (pc *Conn) SetDeadline(t time.Time) error {
+	return pc.conn.SetDeadline(t)
+}
+
+// Close closes the underlying connection
+func (pc *Conn) Close() error {
+	return pc.conn.Close()
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testSecret = []byte("0123456789abcdef")
+
+// frame builds a frame of the given type, ending with its hmac under key when key is set
+func frame(key []byte, seq uint64, typ byte, payload string) []byte {
+	var result = []byte{protocolMagic, protocolVersion, typ}
+	result = binary.BigEndian.AppendUint32(result, uint32(len(payload)))
+	result = append(result, payload...)
+	if key != nil {
+		result = append(result, frameMAC(key, seq, result)...)
+	}
+	return result
+}
+
+// reader returns a connection reading data, expecting frames authenticated under key
+func reader(key []byte, data []byte) *Conn {
+	return &Conn{reader: bufio.NewReader(bytes.NewReader(data)), recvKey: key}
+}
+
+// handshake runs both sides of the handshake over a pipe and returns their connections and errors
+func handshake(controllerSecret, replicaSecret []byte) (*Conn, *Conn, error, error) {
+	var a, b = net.Pipe()
+	var controller, replica = NewConn(a, nil), NewConn(b, nil)
+	var replicaErr = make(chan error, 1)
+	go func() {
+		var err = replica.ReplicaHandshake(replicaSecret)
+		if err != nil {
+			replica.Close()
+		}
+		replicaErr <- err
+	}()
+	var err = controller.ControllerHandshake(controllerSecret)
+	if err != nil {
+		controller.Close()
+	}
+	return controller, replica, err, <-replicaErr
+}
+
+// both sides only finish the handshake when they hold the same secret, and then talk in both directions
+func TestHandshake(t *testing.T) {
+	var tests = []struct {
+		name             string
+		controllerSecret []byte
+		replicaSecret    []byte
+		ok               bool
+	}{
+		{"same secret", testSecret, testSecret, true},
+		{"different secret", testSecret, []byte("fedcba9876543210"), false},
+		{"secret that is a prefix", testSecret, testSecret[:15], false},
+	}
+	for _, test := range tests {
+		var controller, replica, controllerErr, replicaErr = handshake(test.controllerSecret, test.replicaSecret)
+		if !test.ok {
+			if controllerErr == nil || replicaErr == nil {
+				t.Errorf("%s: controller %v, replica %v, want both to fail", test.name, controllerErr, replicaErr)
+			}
+			continue
+		} else if controllerErr != nil || replicaErr != nil {
+			t.Fatalf("%s: controller %v, replica %v", test.name, controllerErr, replicaErr)
+		}
+		go controller.WriteMessage(MsgPingRequest, PingRequest{ID: 7, Client: "8.8.8.8"})
+		var request PingRequest
+		if err := replica.ReadMessage(MsgPingRequest, &request); err != nil || request.ID != 7 || request.Client != "8.8.8.8" {
+			t.Errorf("%s: replica read %v, %v", test.name, request, err)
+		}
+		go replica.WriteMessage(MsgHeartbeat, Heartbeat{Draining: true})
+		var heartbeat Heartbeat
+		if err := controller.ReadMessage(MsgHeartbeat, &heartbeat); err != nil || !heartbeat.Draining {
+			t.Errorf("%s: controller read %v, %v", test.name, heartbeat, err)
+		}
+		controller.Close()
+		replica.Close()
+	}
+}
+
+// the frame hmac covers the key, the sequence number and every byte of the frame
+func TestFrameMAC(t *testing.T) {
+	var key = []byte("session key")
+	var base = frameMAC(key, 3, frame(nil, 0, MsgLoadReport, `{"rps":1}`))
+	var tests = []struct {
+		name string
+		key  []byte
+		seq  uint64
+		typ  byte
+		body string
+		same bool
+	}{
+		{"same frame", key, 3, MsgLoadReport, `{"rps":1}`, true},
+		{"other key", []byte("session kez"), 3, MsgLoadReport, `{"rps":1}`, false},
+		{"other sequence number", key, 4, MsgLoadReport, `{"rps":1}`, false},
+		{"sequence number in the high bytes", key, 3 | 1<<56, MsgLoadReport, `{"rps":1}`, false},
+		{"other type", key, 3, MsgHeartbeat, `{"rps":1}`, false},
+		{"other payload", key, 3, MsgLoadReport, `{"rps":2}`, false},
+	}
+	for _, test := range tests {
+		var mac = frameMAC(test.key, test.seq, frame(nil, 0, test.typ, test.body))
+		if bytes.Equal(mac, base) != test.same {
+			t.Errorf("%s: same hmac %v, want %v", test.name, !test.same, test.same)
+		}
+	}
+}
+
+// once keys are set, frames are only read in the order they were sent, unaltered and under the right key
+func TestFrameSequence(t *testing.T) {
+	var key, other = []byte("receive key"), []byte("another key")
+	var tampered = frame(key, 0, MsgHeartbeat, `{"draining":true}`)
+	tampered[frameHeaderLength+2] ^= 1
+	var tests = []struct {
+		name   string
+		frames [][]byte
+		read   int // frames read before the first error, all of them if it equals len(frames)
+	}{
+		{"in order", [][]byte{frame(key, 0, MsgHeartbeat, `{}`), frame(key, 1, MsgHeartbeat, `{}`), frame(key, 2, MsgDeregister, `{}`)}, 3},
+		{"replayed", [][]byte{frame(key, 0, MsgHeartbeat, `{}`), frame(key, 0, MsgHeartbeat, `{}`)}, 1},
+		{"skipped", [][]byte{frame(key, 0, MsgHeartbeat, `{}`), frame(key, 2, MsgHeartbeat, `{}`)}, 1},
+		{"reordered", [][]byte{frame(key, 1, MsgHeartbeat, `{}`), frame(key, 0, MsgHeartbeat, `{}`)}, 0},
+		{"tampered", [][]byte{tampered}, 0},
+		{"other key", [][]byte{frame(other, 0, MsgHeartbeat, `{}`)}, 0},
+		{"unauthenticated", [][]byte{frame(nil, 0, MsgHeartbeat, `{}`)}, 0},
+		{"bad magic", [][]byte{append([]byte{'G'}, frame(key, 0, MsgHeartbeat, `{}`)[1:]...)}, 0},
+		{"newer version", [][]byte{append([]byte{protocolMagic, protocolVersion + 1}, frame(key, 0, MsgHeartbeat, `{}`)[2:]...)}, 0},
+		{"too long", [][]byte{{protocolMagic, protocolVersion, MsgHeartbeat, 0, 1, 0, 1}}, 0},
+	}
+	for _, test := range tests {
+		var conn = reader(key, bytes.Join(test.frames, nil))
+		var read = 0
+		for ; read < len(test.frames); read++ {
+			if _, _, err := conn.ReadFrame(); err != nil {
+				break
+			}
+		}
+		if read != test.read {
+			t.Errorf("%s: read %d frames, want %d", test.name, read, test.read)
+		}
+	}
+}
+
+// messages of another type than expected are rejected
+func TestReadMessageType(t *testing.T) {
+	var conn = reader(nil, frame(nil, 0, MsgHeartbeat, `{}`))
+	var result PingResult
+	if err := conn.ReadMessage(MsgPingResult, &result); err == nil {
+		t.Error("read a heartbeat as a ping result")
+	}
+}
+
+// the secret file is trimmed and must leave enough secret to be worth anything
+func TestLoadSecret(t *testing.T) {
+	var tests = []struct {
+		contents string
+		secret   string // empty when loading fails
+	}{
+		{"0123456789abcdef", "0123456789abcdef"},
+		{"  0123456789abcdef\n", "0123456789abcdef"},
+		{"0123456789abcde\n", ""},
+		{"\n\n", ""},
+	}
+	var path = filepath.Join(t.TempDir(), "cdn.secret")
+	for _, test := range tests {
+		if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var secret, err = LoadSecret(path)
+		if string(secret) != test.secret || (err == nil) != (test.secret != "") {
+			t.Errorf("LoadSecret(%q) = %q, %v, want %q", test.contents, secret, err, test.secret)
+		}
+	}
+}
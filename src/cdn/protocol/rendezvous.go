@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// the dns server hashes names and the replicas hash path prefixes the same way, so both agree on
+// which replicas own what
+
+// RendezvousOwners returns the k servers with the highest rendezvous hash for key, highest first
+// every server scores keys on its own, so adding or removing one only moves the keys it owned
+func RendezvousOwners(key string, servers []string, k int) []string {
+	var scores = make(map[string]uint64, len(servers))
+	var result = append([]string(nil), servers...)
+	for _, server := range result {
+		scores[server] = rendezvousScore(key, server)
+	}
+	sort.Slice(result, func(i, j int) bool { return scores[result[i]] > scores[result[j]] })
+	if len(result) > k {
+		result = result[:k]
+	}
+	return result
+}
+
+// rendezvousScore hashes the key and server together
+func rendezvousScore(key, server string) uint64 {
+	var hash = fnv.New64a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write([]byte(server))
+	// fnv on its own barely spreads keys that differ in their last bytes, so finish with splitmix64's mixer
+	var x = hash.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
@@ -1,15 +1,90 @@
+import base64
+import hashlib
+import hmac
+import json
+import os
 import socket
+import struct
 import sys
 
+MAGIC = 0xCD
+VERSION = 1
+HELLO, CHALLENGE, AUTH, PING_REQUEST, PING_RESULT = 1, 2, 3, 4, 5
+
+
+def handshake_mac(secret, label, controller_nonce, replica_nonce):
+    return hmac.new(secret, label + controller_nonce + replica_nonce, hashlib.sha256).digest()
+
+
+def encode(obj):
+    # go encodes []byte fields as base64 strings
+    return {k: (base64.b64encode(v).decode() if isinstance(v, bytes) else v) for k, v in obj.items()}
+
+
+class Conn(object):
+    def __init__(self, sock):
+        self.sock = sock
+        self.send_key = self.recv_key = None
+        self.send_seq = self.recv_seq = 0
+
+    def read_exact(self, n):
+        data = b''
+        while len(data) < n:
+            chunk = self.sock.recv(n - len(data))
+            if not chunk:
+                raise EOFError('connection closed')
+            data += chunk
+        return data
+
+    def write(self, typ, obj):
+        payload = json.dumps(encode(obj)).encode()
+        frame = struct.pack('>BBBI', MAGIC, VERSION, typ, len(payload)) + payload
+        if self.send_key:
+            frame += hmac.new(self.send_key, struct.pack('>Q', self.send_seq) + frame, hashlib.sha256).digest()
+            self.send_seq += 1
+        self.sock.sendall(frame)
+
+    def read(self):
+        header = self.read_exact(7)
+        magic, version, typ, length = struct.unpack('>BBBI', header)
+        assert magic == MAGIC and version == VERSION, 'not a control frame'
+        frame = header + self.read_exact(length)
+        if self.recv_key:
+            mac = self.read_exact(32)
+            expected = hmac.new(self.recv_key, struct.pack('>Q', self.recv_seq) + frame, hashlib.sha256).digest()
+            assert hmac.compare_digest(mac, expected), 'frame failed authentication'
+            self.recv_seq += 1
+        return typ, json.loads(frame[7:])
+
+
 if __name__ == '__main__':
-    if len(sys.argv) < 3:
-        print("./{} addr port".format(sys.argv[0]))
+    if len(sys.argv) < 4:
+        print("./{} addr port secret_file [client_ip]".format(sys.argv[0]))
         sys.exit(1)
     addr = (sys.argv[1], int(sys.argv[2]))
+    secret = open(sys.argv[3], 'rb').read().strip()
+    client = sys.argv[4] if len(sys.argv) > 4 else '8.8.8.8'
     print(addr)
     sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
     sock.connect(addr)
-    sock.send(b'8.8.8.8\n')
-    print(sock.recv(1000))
+    conn = Conn(sock)
+
+    ours = os.urandom(32)
+    conn.write(HELLO, {'nonce': ours})
+    typ, challenge = conn.read()
+    theirs = base64.b64decode(challenge['nonce'])
+    mac = base64.b64decode(challenge['mac'])
+    assert typ == CHALLENGE and hmac.compare_digest(mac, handshake_mac(secret, b'cdn replica proof', ours, theirs)), 'replica does not know the secret'
+    conn.write(AUTH, {'mac': handshake_mac(secret, b'cdn controller proof', ours, theirs)})
+    conn.send_key = handshake_mac(secret, b'cdn controller key', ours, theirs)
+    conn.recv_key = handshake_mac(secret, b'cdn replica key', ours, theirs)
+
+    conn.write(PING_REQUEST, {'id': 1, 'client': client})
+    # the replica also sends load and passive rtt reports, which are skipped
+    while True:
+        typ, result = conn.read()
+        if typ == PING_RESULT:
+            break
+    print(result)
     sock.close()
     sys.exit(0)